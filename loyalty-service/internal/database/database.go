@@ -3,12 +3,20 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/paranoiachains/loyalty-api/pkg/database"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"github.com/paranoiachains/loyalty-api/pkg/models"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrRewardExists    = errors.New("reward for this match already exists")
+	ErrOrderRegistered = errors.New("order is already registered")
+)
+
 type LoyaltyStorage struct {
 	*sql.DB
 }
@@ -28,12 +36,14 @@ func Connect(databaseURI string) (LoyaltyStorage, error) {
 }
 
 func (db LoyaltyStorage) CreateAccrual(ctx context.Context, accrualOrderID int, userID int) (*models.Accrual, error) {
+	// redelivered orders are picked up where they were left
 	query := `
 	INSERT INTO orders
 	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (order_id) DO NOTHING
 	`
 	logger.Log.Info("creating order...")
-	_, err := db.ExecContext(ctx, query, accrualOrderID, userID, "REGISTERED", 0)
+	_, err := db.ExecContext(ctx, query, accrualOrderID, userID, models.StatusRegistered, 0)
 	if err != nil {
 		logger.Log.Error("create order (db)", zap.Error(err))
 		return nil, err
@@ -54,18 +64,55 @@ func (db LoyaltyStorage) CreateAccrual(ctx context.Context, accrualOrderID int,
 }
 
 func (db LoyaltyStorage) SetStatus(ctx context.Context, accrualOrderID int, status string) error {
-	query := `
+	return db.setStatus(ctx, accrualOrderID, status, nil)
+}
+
+func (db LoyaltyStorage) SetStatusWithAccrual(ctx context.Context, accrualOrderID int, status string, accrual float64) error {
+	return db.setStatus(ctx, accrualOrderID, status, &accrual)
+}
+
+// accrual is left as is if it's nil
+func (db LoyaltyStorage) setStatus(ctx context.Context, accrualOrderID int, status string, accrual *float64) error {
+	querySelect := `
+	SELECT status FROM orders
+	WHERE order_id = $1
+	FOR UPDATE
+	`
+	queryUpdate := `
 	UPDATE orders
-	SET status = $1
-	WHERE order_id = $2 
+	SET status = $1, accrual = COALESCE($3, accrual)
+	WHERE order_id = $2
 	`
 	logger.Log.Info("setting status...", zap.String("status", status))
 
-	_, err := db.ExecContext(ctx, query, status, accrualOrderID)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRowContext(ctx, querySelect, accrualOrderID).Scan(&current); err != nil {
+		logger.Log.Error("get current status (db)", zap.Error(err))
+		return err
+	}
+
+	if err := database.ValidateTransition(current, status); err != nil {
+		logger.Log.Error("set status", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, queryUpdate, status, accrualOrderID, accrual)
 	if err != nil {
 		logger.Log.Error("set status (db)", zap.Error(err))
 		return err
 	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return err
+	}
 	logger.Log.Info("status set!", zap.String("status", status))
 	return nil
 }
@@ -100,8 +147,8 @@ func (db LoyaltyStorage) UpdateAccrual(ctx context.Context, accrualOrderID int,
 	return nil
 }
 
-func (db LoyaltyStorage) GetOrders(ctx context.Context, userID int) ([]models.Accrual, error) {
-	return nil, nil
+func (db LoyaltyStorage) GetOrders(ctx context.Context, userID int, query database.OrdersQuery) ([]models.Accrual, *database.Cursor, error) {
+	return nil, nil, nil
 }
 
 func (db LoyaltyStorage) GetOrder(ctx context.Context, accrualOrderID int) (*models.Accrual, error) {
@@ -122,6 +169,14 @@ func (db LoyaltyStorage) GetOrder(ctx context.Context, accrualOrderID int) (*mod
 	return &order, nil
 }
 
+func (db LoyaltyStorage) CreateAccruals(ctx context.Context, accrualOrderIDs []int, userID int) ([]error, error) {
+	return nil, nil
+}
+
+func (db LoyaltyStorage) GetOrderHistory(ctx context.Context, accrualOrderID int, userID int) ([]models.StatusChange, error) {
+	return nil, nil
+}
+
 func (db LoyaltyStorage) CreateUser(ctx context.Context, username, password string) (*models.User, error) {
 	return nil, nil
 }
@@ -129,3 +184,133 @@ func (db LoyaltyStorage) CreateUser(ctx context.Context, username, password stri
 func (db LoyaltyStorage) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
 	return nil, nil
 }
+
+func (db LoyaltyStorage) Rewards(ctx context.Context) ([]models.Reward, error) {
+	query := `
+	SELECT match, reward, reward_type
+	FROM rewards
+	`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		logger.Log.Error("query rewards", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	rewards := make([]models.Reward, 0)
+	for rows.Next() {
+		var reward models.Reward
+		if err := rows.Scan(&reward.Match, &reward.Reward, &reward.RewardType); err != nil {
+			logger.Log.Error("scan reward", zap.Error(err))
+			return nil, err
+		}
+		rewards = append(rewards, reward)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return rewards, nil
+}
+
+func (db LoyaltyStorage) OrderGoods(ctx context.Context, accrualOrderID int) ([]models.Good, error) {
+	query := `
+	SELECT description, price
+	FROM order_goods
+	WHERE order_id = $1
+	`
+
+	rows, err := db.QueryContext(ctx, query, accrualOrderID)
+	if err != nil {
+		logger.Log.Error("query order goods", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	goods := make([]models.Good, 0)
+	for rows.Next() {
+		var good models.Good
+		if err := rows.Scan(&good.Description, &good.Price); err != nil {
+			logger.Log.Error("scan good", zap.Error(err))
+			return nil, err
+		}
+		goods = append(goods, good)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return goods, nil
+}
+
+// CreateReward returns ErrRewardExists if a match differing only in case is registered
+func (db LoyaltyStorage) CreateReward(ctx context.Context, reward models.Reward) error {
+	query := `
+	INSERT INTO rewards (match, reward, reward_type)
+	VALUES ($1, $2, $3)
+	`
+	logger.Log.Info("creating reward...", zap.String("match", reward.Match))
+
+	_, err := db.ExecContext(ctx, query, reward.Match, reward.Reward, reward.RewardType)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrRewardExists
+		}
+		logger.Log.Error("create reward (db)", zap.Error(err))
+		return err
+	}
+
+	logger.Log.Info("reward created!", zap.String("match", reward.Match))
+	return nil
+}
+
+func (db LoyaltyStorage) RegisterOrder(ctx context.Context, accrualOrderID int, goods []models.Good) error {
+	queryOrder := `
+	INSERT INTO registered_orders (order_id)
+	VALUES ($1)
+	`
+	queryGood := `
+	INSERT INTO order_goods (order_id, description, price)
+	VALUES ($1, $2, $3)
+	`
+	logger.Log.Info("registering order, starting tx...", zap.Int("order_id", accrualOrderID))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, queryOrder, accrualOrderID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrOrderRegistered
+		}
+		logger.Log.Error("register order (db)", zap.Error(err))
+		return err
+	}
+
+	for _, good := range goods {
+		_, err = tx.ExecContext(ctx, queryGood, accrualOrderID, good.Description, good.Price)
+		if err != nil {
+			logger.Log.Error("add order good (db)", zap.Error(err))
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return err
+	}
+
+	logger.Log.Info("order registered!", zap.Int("order_id", accrualOrderID))
+	return nil
+}
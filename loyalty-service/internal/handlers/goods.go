@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/loyalty-service/internal/database"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+type RewardSaver interface {
+	CreateReward(ctx context.Context, reward models.Reward) error
+}
+
+func RegisterGoods(db RewardSaver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reward models.Reward
+
+		if err := c.ShouldBindJSON(&reward); err != nil {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if reward.Match == "" || reward.Reward <= 0 {
+			c.String(http.StatusBadRequest, "match and positive reward are required")
+			return
+		}
+
+		switch reward.RewardType {
+		case models.RewardPercent, models.RewardPoints:
+		default:
+			c.String(http.StatusBadRequest, "reward_type must be '%' or 'pt'")
+			return
+		}
+
+		if reward.RewardType == models.RewardPercent && reward.Reward > 100 {
+			c.String(http.StatusBadRequest, "percent reward can't exceed 100")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := db.CreateReward(ctx, reward); err != nil {
+			if errors.Is(err, database.ErrRewardExists) {
+				logger.Log.Warn("create reward", zap.Error(err))
+				c.String(http.StatusConflict, "reward for this match already registered")
+				return
+			}
+			logger.Log.Error("create reward", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.String(http.StatusOK, "reward registered!")
+	}
+}
@@ -2,15 +2,96 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/loyalty-service/internal/database"
 	"github.com/paranoiachains/loyalty-api/pkg/app"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
 	"go.uber.org/zap"
 )
 
+type OrderRegistrar interface {
+	RegisterOrder(ctx context.Context, accrualOrderID int, goods []models.Good) error
+}
+
+// OrderEvaluator evaluates an order which arrived before its goods were registered
+type OrderEvaluator interface {
+	EvaluateRegistered(ctx context.Context, orderID int) error
+}
+
+// RegisterOrder stores the goods of an order. If the order was uploaded before,
+// it is evaluated in the background.
+func RegisterOrder(db OrderRegistrar, evaluator OrderEvaluator, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := struct {
+			Order string        `json:"order"`
+			Goods []models.Good `json:"goods"`
+		}{}
+
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if err := goluhn.Validate(request.Order); err != nil {
+			logger.Log.Error("luhn validation", zap.Error(err))
+			c.String(http.StatusBadRequest, "invalid order number")
+			return
+		}
+
+		orderID, err := strconv.Atoi(request.Order)
+		if err != nil {
+			logger.Log.Error("string to int", zap.Error(err))
+			c.String(http.StatusBadRequest, "invalid order number")
+			return
+		}
+
+		if len(request.Goods) == 0 {
+			c.String(http.StatusBadRequest, "goods list is required")
+			return
+		}
+
+		for _, good := range request.Goods {
+			if good.Description == "" || good.Price < 0 {
+				c.String(http.StatusBadRequest, "every good needs a description and a non-negative price")
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := db.RegisterOrder(ctx, orderID, request.Goods); err != nil {
+			if errors.Is(err, database.ErrOrderRegistered) {
+				logger.Log.Warn("register order", zap.Error(err))
+				c.String(http.StatusConflict, "order already registered")
+				return
+			}
+			logger.Log.Error("register order", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			if err := evaluator.EvaluateRegistered(ctx, orderID); err != nil {
+				logger.Log.Error("evaluate registered order", zap.Int("order_id", orderID), zap.Error(err))
+			}
+		}()
+
+		c.String(http.StatusAccepted, "order registered!")
+	}
+}
+
 func GetOrder(app *app.App) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		accrualOrderID := c.Param("number")
@@ -1,11 +1,53 @@
 package process
 
 import (
-	"math/rand/v2"
-	"time"
+	"math"
+	"strings"
+
+	"github.com/paranoiachains/loyalty-api/pkg/models"
 )
 
-func Evaluate() float64 {
-	time.Sleep(1 * time.Second)
-	return rand.Float64() * 500
+// Evaluate sums the accrual for the goods of an order. Each good is rewarded by
+// the rule whose match string it contains; goods without a matching rule earn nothing.
+func Evaluate(rewards []models.Reward, goods []models.Good) float64 {
+	var accrual float64
+
+	for _, good := range goods {
+		reward, ok := matchReward(rewards, good.Description)
+		if !ok {
+			continue
+		}
+
+		switch reward.RewardType {
+		case models.RewardPercent:
+			accrual += good.Price * reward.Reward / 100
+		case models.RewardPoints:
+			accrual += reward.Reward
+		}
+	}
+
+	return math.Round(accrual*100) / 100
+}
+
+// matchReward picks the rule matching the description (case-insensitive).
+// If several rules match, the most specific (longest) match string wins.
+func matchReward(rewards []models.Reward, description string) (models.Reward, bool) {
+	var (
+		best  models.Reward
+		found bool
+	)
+	description = strings.ToLower(description)
+
+	for _, reward := range rewards {
+		if reward.Match == "" || !strings.Contains(description, strings.ToLower(reward.Match)) {
+			continue
+		}
+		if !found || len(reward.Match) > len(best.Match) ||
+			(len(reward.Match) == len(best.Match) && reward.Match < best.Match) {
+			best = reward
+			found = true
+		}
+	}
+
+	return best, found
 }
@@ -2,7 +2,10 @@ package process
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/paranoiachains/loyalty-api/pkg/database"
@@ -13,106 +16,247 @@ import (
 )
 
 const (
-	Processing = "PROCESSING"
-	Processed  = "PROCESSED"
-	Invalid    = "INVALID"
+	Processing = models.StatusProcessing
+	Processed  = models.StatusProcessed
+	Invalid    = models.StatusInvalid
 )
 
-func SendStatus(status string, orderID int, p *LoyaltyProcessor) error {
+// used when OrderTimeout isn't set
+const defaultOrderTimeout = 30 * time.Second
+
+// SendStatus publishes a status change of the order, accrual is only known once it's PROCESSED
+func SendStatus(status string, orderID int, accrual float64, p *LoyaltyProcessor) error {
 	logger.Log.Info("sending status...", zap.String("status", status), zap.Int("orderID", orderID))
 	statusMessage := models.AccrualStatusUpdate{
 		OrderID: orderID,
 		Status:  status,
+		Accrual: accrual,
 	}
 
-	payload, err := json.Marshal(&statusMessage)
+	payload, err := messaging.Marshal(messaging.EventOrderStatus, messaging.ProducerLoyaltyService, &statusMessage)
 	if err != nil {
 		logger.Log.Error("marshal status message", zap.Error(err))
 		return err
 
 	}
-	p.StatusBroker.Send(payload)
+	p.StatusBroker.Send(strconv.Itoa(orderID), payload)
 
 	logger.Log.Info("status sent!", zap.String("status", status), zap.Int("orderID", orderID))
 
 	return nil
 }
 
+// RewardStorage provides merchant reward rules and registered order goods
+type RewardStorage interface {
+	Rewards(ctx context.Context) ([]models.Reward, error)
+	OrderGoods(ctx context.Context, accrualOrderID int) ([]models.Good, error)
+}
+
 type LoyaltyProcessor struct {
 	DB           database.Storage
+	Rewards      RewardStorage
 	Broker       messaging.MessageBroker
 	StatusBroker messaging.MessageBroker
+	Topics       messaging.Topics
+	DeadLetters  messaging.Publisher
+	Retry        messaging.RetryPolicy
+	Workers      int
+	OrderTimeout time.Duration
 }
 
 func (p LoyaltyProcessor) Process(ctx context.Context) {
-	logger.Log.Info("processor started!")
-	for data := range p.Broker.Receive() {
-		var order models.Accrual
-		logger.Log.Info("unmarshalling order...")
-		err := json.Unmarshal(data, &order)
-		if err != nil {
-			logger.Log.Error("unmarshal data", zap.Error(err))
-			continue
-		}
+	workers := max(p.Workers, 1)
+	logger.Log.Info("processor started!", zap.Int("workers", workers))
 
-		date := order.UploadTime
+	messages := p.Broker.Receive()
 
-		createdOrder, err := p.DB.CreateAccrual(ctx, order.AccrualOrderID, order.UserID)
-		if err != nil {
-			logger.Log.Error("create order", zap.Error(err))
-			continue
-		}
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.worker(ctx, messages)
+		}()
+	}
 
-		logger.Log.Info("order created", zap.String("status", createdOrder.Status))
+	// wait for in-flight orders before returning
+	wg.Wait()
+	logger.Log.Info("processor stopped")
+}
 
-		// set order status to 'PROCESSING'
-		err = p.DB.SetStatus(ctx, order.AccrualOrderID, Processing)
-		if err != nil {
-			logger.Log.Error("set status (db)", zap.Error(err))
-			continue
+func (p LoyaltyProcessor) worker(ctx context.Context, messages <-chan messaging.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			p.processOrder(ctx, msg)
 		}
+	}
+}
 
-		SendStatus(Processing, createdOrder.AccrualOrderID, &p)
+func (p LoyaltyProcessor) processOrder(ctx context.Context, msg messaging.Message) {
+	timeout := p.OrderTimeout
+	if timeout <= 0 {
+		timeout = defaultOrderTimeout
+	}
 
-		// imitate evaluation
-		time.Sleep(15 * time.Second)
+	// an order started before shutdown is allowed to finish within its own timeout
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
 
-		// evaluate accrual
-		logger.Log.Info("evaluating accrual...")
-		accrual := Evaluate()
-		logger.Log.Info("accrual evaluated!")
+	err := messaging.Handle(ctx, p.Retry, p.DeadLetters, p.Topics.OrderCreated, msg, p.evaluateOrder)
+	if err != nil {
+		logger.Log.Error("handle created order", zap.Error(err))
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
 
-		err = p.DB.UpdateAccrual(context.Background(), createdOrder.AccrualOrderID, accrual)
-		if err != nil {
-			logger.Log.Error("update accrual", zap.Error(err))
-			continue
-		}
+func (p LoyaltyProcessor) evaluateOrder(ctx context.Context, data []byte) error {
+	var order models.Accrual
+	logger.Log.Info("unmarshalling order...")
+	_, err := messaging.Unmarshal(data, messaging.EventOrderCreated, &order)
+	if err != nil {
+		logger.Log.Error("unmarshal data", zap.Error(err))
+		return messaging.Permanent(err)
+	}
 
-		// set status to 'PROCESSED'
-		err = p.DB.SetStatus(ctx, createdOrder.AccrualOrderID, Processed)
-		if err != nil {
-			logger.Log.Error("set status (db)", zap.Error(err))
-			continue
-		}
+	date := order.UploadTime
 
-		SendStatus(Processed, createdOrder.AccrualOrderID, &p)
+	createdOrder, err := p.DB.CreateAccrual(ctx, order.AccrualOrderID, order.UserID)
+	if err != nil {
+		logger.Log.Error("create order", zap.Error(err))
+		return err
+	}
 
-		// retrieve order from db
-		processedOrder, err := p.DB.GetOrder(context.Background(), createdOrder.AccrualOrderID)
-		if err != nil {
-			logger.Log.Error("get order", zap.Error(err))
-			continue
+	logger.Log.Info("order created", zap.String("status", createdOrder.Status))
+
+	// a redelivered order which was already evaluated only has its events sent again.
+	// PROCESSING goes first: if it was lost, the order service couldn't move the order
+	// from NEW to the final status, and if it wasn't, the order service ignores it.
+	switch createdOrder.Status {
+	case Processed:
+		if err := SendStatus(Processing, createdOrder.AccrualOrderID, 0, &p); err != nil {
+			return err
+		}
+		return p.completeOrder(ctx, createdOrder.AccrualOrderID, date)
+	case Invalid:
+		if err := SendStatus(Processing, createdOrder.AccrualOrderID, 0, &p); err != nil {
+			return err
 		}
+		return SendStatus(Invalid, createdOrder.AccrualOrderID, 0, &p)
+	}
 
-		processedOrder.UploadTime = date
+	// set order status to 'PROCESSING'
+	err = p.setStatus(ctx, order.AccrualOrderID, Processing)
+	if err != nil {
+		logger.Log.Error("set status (db)", zap.Error(err))
+		return err
+	}
 
-		// send back to kafka processed data
-		processedData, err := json.Marshal(processedOrder)
-		if err != nil {
-			logger.Log.Error("marshal json", zap.Error(err))
-			continue
-		}
+	if err := SendStatus(Processing, createdOrder.AccrualOrderID, 0, &p); err != nil {
+		return err
+	}
 
-		p.Broker.Send(processedData)
+	return p.evaluate(ctx, createdOrder.AccrualOrderID, date)
+}
+
+// EvaluateRegistered evaluates an order which was waiting for its goods. Orders which
+// haven't arrived yet or were already evaluated are left alone.
+func (p LoyaltyProcessor) EvaluateRegistered(ctx context.Context, orderID int) error {
+	order, err := p.DB.GetOrder(ctx, orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+
+	if order.Status != Processing {
+		return nil
+	}
+
+	return p.evaluate(ctx, orderID, nil)
+}
+
+// evaluates an order in PROCESSING. Goods may be registered after the order arrives,
+// until then it stays in PROCESSING and EvaluateRegistered picks it up later.
+func (p LoyaltyProcessor) evaluate(ctx context.Context, orderID int, date *time.Time) error {
+	goods, err := p.Rewards.OrderGoods(ctx, orderID)
+	if err != nil {
+		logger.Log.Error("get order goods", zap.Error(err))
+		return err
+	}
+
+	if len(goods) == 0 {
+		logger.Log.Info("no goods registered for order yet", zap.Int("order_id", orderID))
+		return nil
+	}
+
+	rewards, err := p.Rewards.Rewards(ctx)
+	if err != nil {
+		logger.Log.Error("get rewards", zap.Error(err))
+		return err
+	}
+
+	// evaluate accrual
+	logger.Log.Info("evaluating accrual...")
+	accrual := Evaluate(rewards, goods)
+	logger.Log.Info("accrual evaluated!", zap.Float64("accrual", accrual))
+
+	err = p.DB.UpdateAccrual(ctx, orderID, accrual)
+	if err != nil {
+		logger.Log.Error("update accrual", zap.Error(err))
+		return err
+	}
+
+	// set status to 'PROCESSED'
+	err = p.setStatus(ctx, orderID, Processed)
+	if err != nil {
+		logger.Log.Error("set status (db)", zap.Error(err))
+		return err
+	}
+
+	return p.completeOrder(ctx, orderID, date)
+}
+
+// retrying can't make an illegal transition legal, so it's a permanent failure
+func (p LoyaltyProcessor) setStatus(ctx context.Context, orderID int, status string) error {
+	err := p.DB.SetStatus(ctx, orderID, status)
+	if errors.Is(err, database.ErrIllegalTransition) || errors.Is(err, database.ErrUnknownStatus) {
+		return messaging.Permanent(err)
+	}
+	return err
+}
+
+// sends the PROCESSED status and the evaluated order back to the order service
+func (p LoyaltyProcessor) completeOrder(ctx context.Context, orderID int, date *time.Time) error {
+	// retrieve order from db
+	processedOrder, err := p.DB.GetOrder(ctx, orderID)
+	if err != nil {
+		logger.Log.Error("get order", zap.Error(err))
+		return err
+	}
+
+	if err := SendStatus(Processed, orderID, processedOrder.Accrual, &p); err != nil {
+		return err
+	}
+
+	processedOrder.UploadTime = date
+
+	// send back to kafka processed data
+	processedData, err := messaging.Marshal(messaging.EventOrderCompleted, messaging.ProducerLoyaltyService, processedOrder)
+	if err != nil {
+		logger.Log.Error("marshal json", zap.Error(err))
+		return err
+	}
+
+	p.Broker.Send(strconv.Itoa(processedOrder.AccrualOrderID), processedData)
+
+	return nil
 }
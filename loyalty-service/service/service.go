@@ -0,0 +1,129 @@
+// Package service runs loyalty-service. It is importable from outside the service,
+// so tools/devstack can run it in one process with order-service and sso-service.
+package service
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/loyalty-service/internal/database"
+	"github.com/paranoiachains/loyalty-api/loyalty-service/internal/handlers"
+	"github.com/paranoiachains/loyalty-api/loyalty-service/internal/process"
+	"github.com/paranoiachains/loyalty-api/pkg/app"
+	ssoauth "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/middleware"
+	"go.uber.org/zap"
+)
+
+// Processor evaluates the accrual of created orders
+type Processor = process.LoyaltyProcessor
+
+// Run serves the accrual api on flags.AccrualSystemAddress and processes orders until
+// ctx is done. It returns once the in-flight orders are finished.
+func Run(ctx context.Context) error {
+	var loyaltyApp *app.App
+
+	// stops the processor if the http server fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger.Log.Debug("DSN", zap.String("postgres", flags.LoyaltyDatabaseDSN))
+	db, err := database.Connect(flags.LoyaltyDatabaseDSN)
+	if err != nil {
+		return err
+	}
+
+	tokenKeys, err := app.TokenKeyfunc()
+	if err != nil {
+		return err
+	}
+
+	authClient, err := ssoauth.New(flags.SSOAuthAddress)
+	if err != nil {
+		return err
+	}
+
+	messagingCfg := app.MessagingConfig(messaging.ProducerLoyaltyService)
+	revoked := app.RevocationList(ctx, authClient, messagingCfg)
+
+	loyaltyKafka := messaging.NewLoyaltyBroker(messagingCfg)
+	loyaltyStatus := messaging.NewLoyaltyStatusBroker(messagingCfg)
+
+	processor := &process.LoyaltyProcessor{
+		DB:           db,
+		Rewards:      db,
+		Broker:       loyaltyKafka,
+		StatusBroker: loyaltyStatus,
+		Topics:       messagingCfg.Topics,
+		DeadLetters:  messaging.NewPublisher(messagingCfg),
+		Retry:        app.RetryPolicy(),
+		Workers:      flags.AccrualWorkers,
+		OrderTimeout: flags.AccrualOrderTimeout,
+	}
+
+	loyaltyApp = &app.App{
+		DB:          db,
+		Kafka:       loyaltyKafka,
+		Processor:   processor,
+		StatusKafka: loyaltyStatus,
+	}
+
+	loyaltyApp.Kafka.Start(context.Background())
+	loyaltyApp.StatusKafka.Start(context.Background())
+
+	processed := make(chan struct{})
+	go func() {
+		loyaltyApp.Processor.Process(ctx)
+		close(processed)
+	}()
+
+	if flags.MerchantKey == "" {
+		logger.Log.Warn("no merchant key is set, rewards and orders can't be registered")
+	}
+
+	r := gin.New()
+	r.Use(middleware.Logger(), middleware.Compression())
+
+	userGroup := r.Group("/")
+	userGroup.Use(middleware.Auth(tokenKeys, revoked), middleware.RateLimitMiddleware())
+	{
+		userGroup.GET("/api/orders/:number", handlers.GetOrder(loyaltyApp))
+	}
+
+	// merchants feed the accrual engine, a user token must not let anyone credit themselves
+	merchantGroup := r.Group("/")
+	merchantGroup.Use(middleware.MerchantAuth(flags.MerchantKey))
+	{
+		merchantGroup.POST("/api/orders", handlers.RegisterOrder(db, processor, flags.AccrualOrderTimeout))
+		merchantGroup.POST("/api/goods", handlers.RegisterGoods(db))
+	}
+
+	srv := &http.Server{Addr: flags.AccrualSystemAddress, Handler: r}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-served:
+		logger.Log.Error("run http server", zap.Error(err))
+		cancel()
+	case <-ctx.Done():
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelShutdown()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Log.Error("shutdown http server", zap.Error(err))
+		}
+	}
+
+	// wait for in-flight orders
+	<-processed
+	logger.Log.Info("gracefully stopped")
+
+	return err
+}
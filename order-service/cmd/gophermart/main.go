@@ -2,23 +2,17 @@ package main
 
 import (
 	"context"
+	"os/signal"
+	"syscall"
 
-	"github.com/paranoiachains/loyalty-api/order-service/internal/app"
-	"github.com/paranoiachains/loyalty-api/order-service/internal/server"
-
-	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/order-service/service"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	application, err := app.New(ctx)
-	if err != nil {
+	if err := service.Run(ctx); err != nil {
 		panic(err)
 	}
-
-	go application.Processor.Process(ctx)
-
-	srv := server.New(application)
-	srv.Run(flags.RunAddress)
 }
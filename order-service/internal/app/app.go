@@ -2,42 +2,92 @@ package app
 
 import (
 	"context"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/paranoiachains/loyalty-api/order-service/internal/database"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/outbox"
 	"github.com/paranoiachains/loyalty-api/order-service/internal/process"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/stream"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/webhooks"
 	"github.com/paranoiachains/loyalty-api/pkg/app"
 	auth "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
 	withdraw "github.com/paranoiachains/loyalty-api/pkg/clients/sso/withdraw"
 	"github.com/paranoiachains/loyalty-api/pkg/flags"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/revocation"
 	"go.uber.org/zap"
 )
 
-func New(ctx context.Context) (*app.App, error) {
+// App is the shared application plus the state only order-service has
+type App struct {
+	*app.App
+	// order updates consumed by the processor, streamed to users
+	Updates *stream.Hub
+	// webhook subscriptions and their delivery log
+	Webhooks webhooks.Storage
+	// selects the key verifying a token
+	TokenKeys jwt.Keyfunc
+	Revoked   *revocation.List
+}
+
+func New(ctx context.Context) (*App, error) {
 	logger.Log.Debug("Connecting to database", zap.String("dsn", flags.OrderDatabaseDSN))
 	db, err := database.Connect(flags.OrderDatabaseDSN)
 	if err != nil {
 		return nil, err
 	}
 
-	authClient, err := auth.New("sso-service:5000")
+	tokenKeys, err := app.TokenKeyfunc()
+	if err != nil {
+		return nil, err
+	}
+
+	authClient, err := auth.New(flags.SSOAuthAddress)
 	if err != nil {
 		return nil, err
 	}
 
-	withdrawClient, err := withdraw.New("sso-service:5001")
+	withdrawClient, err := withdraw.New(flags.SSOWithdrawAddress)
 	if err != nil {
 		return nil, err
 	}
 
-	orderKafka := messaging.InitOrderKafka()
-	statusKafka := messaging.InitStatusOrder()
+	messagingCfg := app.MessagingConfig(messaging.ProducerOrderService)
+
+	orderKafka := messaging.NewOrderBroker(messagingCfg)
+	statusKafka := messaging.NewOrderStatusBroker(messagingCfg)
 
 	orderKafka.Start(ctx)
 	statusKafka.Start(ctx)
 
-	return &app.App{
+	relay := outbox.Relay{
+		DB:          db,
+		Topic:       messaging.TopicOrderCreated,
+		Destination: messagingCfg.Topics.OrderCreated,
+		Publisher:   messaging.NewEventPublisher(messagingCfg),
+		Interval:    time.Second,
+		BatchSize:   100,
+	}
+	go relay.Run(ctx)
+
+	updates := stream.NewHub()
+
+	dispatcher := webhooks.Dispatcher{
+		DB:     db,
+		Client: webhooks.NewClient(10 * time.Second),
+		Retry: messaging.RetryPolicy{
+			Attempts:       8,
+			InitialBackoff: 30 * time.Second,
+			MaxBackoff:     time.Hour,
+		},
+		Interval:  time.Second,
+		BatchSize: 100,
+	}
+	go dispatcher.Run(ctx)
+
+	shared := &app.App{
 		DB:          db,
 		Kafka:       orderKafka,
 		StatusKafka: statusKafka,
@@ -46,8 +96,21 @@ func New(ctx context.Context) (*app.App, error) {
 			Broker:         orderKafka,
 			StatusBroker:   statusKafka,
 			WithdrawClient: withdrawClient,
+			Topics:         messagingCfg.Topics,
+			DeadLetters:    messaging.NewPublisher(messagingCfg),
+			Retry:          app.RetryPolicy(),
+			Updates:        updates,
+			Webhooks:       dispatcher,
 		},
 		AuthClient:     authClient,
 		WithdrawClient: withdrawClient,
+	}
+
+	return &App{
+		App:       shared,
+		Updates:   updates,
+		Webhooks:  db,
+		TokenKeys: tokenKeys,
+		Revoked:   app.RevocationList(ctx, authClient, messagingCfg),
 	}, nil
 }
@@ -4,10 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strconv"
 
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/paranoiachains/loyalty-api/pkg/database"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
 	"github.com/paranoiachains/loyalty-api/pkg/models"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
@@ -86,61 +88,266 @@ func (db OrderStorage) GetUserByUsername(ctx context.Context, username string) (
 	return &user, nil
 }
 
+// creates accrual and enqueues its order-created event in the same tx
 func (db OrderStorage) CreateAccrual(ctx context.Context, accrualOrderID int, userID int) (*models.Accrual, error) {
-	logger.Log.Info("checking existing accrual...")
+	logger.Log.Info("creating accrual, starting tx...")
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	var existingUserID int
-	err := db.QueryRowContext(ctx, `
-		SELECT user_id FROM accruals WHERE accrual_order_id = $1
-	`, accrualOrderID).Scan(&existingUserID)
+	order, err := createAccrual(ctx, tx, accrualOrderID, userID)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == nil {
-		if existingUserID == userID {
-			return nil, database.ErrAlreadyExists
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return nil, err
+	}
+	logger.Log.Info("accrual returned!")
+
+	return order, nil
+}
+
+// creates accruals of several orders in one tx. The returned slice holds the result
+// of each order in the same order: nil when it was created, database.ErrAlreadyExists
+// or database.ErrAnotherUser when it had been uploaded before. Any other error fails the whole batch
+func (db OrderStorage) CreateAccruals(ctx context.Context, accrualOrderIDs []int, userID int) ([]error, error) {
+	logger.Log.Info("creating accruals, starting tx...", zap.Int("count", len(accrualOrderIDs)))
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]error, len(accrualOrderIDs))
+	for i, accrualOrderID := range accrualOrderIDs {
+		_, err := createAccrual(ctx, tx, accrualOrderID, userID)
+		if errors.Is(err, database.ErrAlreadyExists) || errors.Is(err, database.ErrAnotherUser) {
+			results[i] = err
+			continue
+		}
+		if err != nil {
+			logger.Log.Error("create accrual", zap.Int("accrual_order_id", accrualOrderID), zap.Error(err))
+			return nil, err
 		}
-		return nil, database.ErrAnotherUser
 	}
-	if err != sql.ErrNoRows {
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
 		return nil, err
 	}
+	logger.Log.Info("accruals created!")
+
+	return results, nil
+}
 
+// inserts the accrual, its first history entry and its order-created event.
+// A concurrent upload of the same number makes the insert a no-op instead of
+// failing the tx, the owner of the existing order is read afterwards.
+func createAccrual(ctx context.Context, tx *sql.Tx, accrualOrderID int, userID int) (*models.Accrual, error) {
 	logger.Log.Info("creating accrual...")
 	query := `
 		INSERT INTO accruals (accrual_order_id, user_id, status)
-		VALUES ($1, $2, $3);
+		VALUES ($1, $2, $3)
+		ON CONFLICT (accrual_order_id) DO NOTHING
+		RETURNING accrual_order_id, user_id, status, accrual, uploaded_at;
 	`
-	_, err = db.ExecContext(ctx, query, accrualOrderID, userID, "NEW")
+	var order models.Accrual
+	row := tx.QueryRowContext(ctx, query, accrualOrderID, userID, models.StatusNew)
+	err := row.Scan(&order.AccrualOrderID, &order.UserID, &order.Status, &order.Accrual, &order.UploadTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		var existingUserID int
+		err := tx.QueryRowContext(ctx, `
+			SELECT user_id FROM accruals WHERE accrual_order_id = $1
+		`, accrualOrderID).Scan(&existingUserID)
+		if err != nil {
+			return nil, err
+		}
+
+		if existingUserID == userID {
+			return nil, database.ErrAlreadyExists
+		}
+		return nil, database.ErrAnotherUser
+	}
 	if err != nil {
 		return nil, err
 	}
 	logger.Log.Info("accrual created!")
 
-	logger.Log.Info("returning accrual from db...")
-	var order models.Accrual
-	row := db.QueryRowContext(ctx,
-		`SELECT accrual_order_id, user_id, status, accrual, uploaded_at FROM accruals WHERE accrual_order_id = $1`,
-		accrualOrderID)
-	err = row.Scan(&order.AccrualOrderID, &order.UserID, &order.Status, &order.Accrual, &order.UploadTime)
+	if err := recordTransition(ctx, tx, order.AccrualOrderID, "", order.Status); err != nil {
+		logger.Log.Error("record status transition", zap.Error(err))
+		return nil, err
+	}
+
+	payload, err := messaging.Marshal(messaging.EventOrderCreated, messaging.ProducerOrderService, &order)
 	if err != nil {
+		logger.Log.Error("marshal order-created event", zap.Error(err))
+		return nil, err
+	}
+
+	if err := enqueue(ctx, tx, messaging.TopicOrderCreated, strconv.Itoa(order.AccrualOrderID), payload); err != nil {
+		logger.Log.Error("enqueue order-created event", zap.Error(err))
 		return nil, err
 	}
-	logger.Log.Info("accrual returned!")
 
 	return &order, nil
 }
 
+// writes an event to the outbox, it is published later by the relay.
+// key is the order number, it keeps events of one order on one partition
+func enqueue(ctx context.Context, tx *sql.Tx, topic, key string, payload []byte) error {
+	query := `
+	INSERT INTO outbox (topic, key, payload)
+	VALUES ($1, $2, $3);
+	`
+	_, err := tx.ExecContext(ctx, query, topic, key, payload)
+	return err
+}
+
+// locks up to limit unsent events of the topic, hands them to publish at once
+// and marks them sent. Rows stay pending if publish fails, so the next call retries them.
+func (db OrderStorage) PublishPending(
+	ctx context.Context,
+	topic string,
+	limit int,
+	publish func([]models.OutboxMessage) error,
+) (int, error) {
+	querySelect := `
+	SELECT id, topic, key, payload, created_at
+	FROM outbox
+	WHERE topic = $1 AND sent_at IS NULL
+	ORDER BY id
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED;
+	`
+	queryMark := `
+	UPDATE outbox
+	SET sent_at = NOW()
+	WHERE id = ANY($1);
+	`
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, querySelect, topic, limit)
+	if err != nil {
+		logger.Log.Error("query outbox", zap.Error(err))
+		return 0, err
+	}
+
+	messages := make([]models.OutboxMessage, 0, limit)
+	for rows.Next() {
+		var msg models.OutboxMessage
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &msg.Payload, &msg.CreatedAt); err != nil {
+			rows.Close()
+			logger.Log.Error("scan outbox row", zap.Error(err))
+			return 0, err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return 0, err
+	}
+
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if err := publish(messages); err != nil {
+		logger.Log.Error("publish outbox messages", zap.Int("count", len(messages)), zap.Error(err))
+		return 0, err
+	}
+
+	ids := make([]int64, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	if _, err := tx.ExecContext(ctx, queryMark, ids); err != nil {
+		logger.Log.Error("mark outbox messages sent", zap.Error(err))
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// moves the order to status and records the transition in its history.
+// Setting the current status again is a no-op, transitions outside
+// of the status model return *database.TransitionError
 func (db OrderStorage) SetStatus(ctx context.Context, accrualOrderID int, status string) error {
+	return db.setStatus(ctx, accrualOrderID, status, nil)
+}
+
+// like SetStatus, the accrual is stored before the transition is recorded,
+// so the history entry carries it
+func (db OrderStorage) SetStatusWithAccrual(ctx context.Context, accrualOrderID int, status string, accrual float64) error {
+	return db.setStatus(ctx, accrualOrderID, status, &accrual)
+}
+
+// accrual is left as is if it's nil
+func (db OrderStorage) setStatus(ctx context.Context, accrualOrderID int, status string, accrual *float64) error {
 	logger.Log.Info("setting status...'",
 		zap.Int("accrual_order_id", accrualOrderID),
 		zap.String("status", status))
 
-	query := `
+	querySelect := `
+	SELECT status FROM accruals
+	WHERE accrual_order_id = $1
+	FOR UPDATE;
+	`
+	queryUpdate := `
 	UPDATE accruals
-	SET status = $1
+	SET status = $1, accrual = COALESCE($3, accrual)
 	WHERE accrual_order_id = $2;
 	`
-	_, err := db.ExecContext(ctx, query, status, accrualOrderID)
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(ctx, querySelect, accrualOrderID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if err := database.ValidateTransition(current, status); err != nil {
+		return err
+	}
+	if current == status {
+		logger.Log.Info("status already set", zap.Int("accrual_order_id", accrualOrderID), zap.String("status", status))
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, queryUpdate, status, accrualOrderID, accrual); err != nil {
+		return err
+	}
+
+	if err := recordTransition(ctx, tx, accrualOrderID, current, status); err != nil {
+		logger.Log.Error("record status transition", zap.Error(err))
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
 		return err
 	}
 
@@ -152,6 +359,19 @@ func (db OrderStorage) SetStatus(ctx context.Context, accrualOrderID int, status
 
 }
 
+// appends a status change to the order history along with the order's current accrual,
+// from is empty for a new order
+func recordTransition(ctx context.Context, tx *sql.Tx, accrualOrderID int, from, to string) error {
+	query := `
+	INSERT INTO order_status_history (accrual_order_id, from_status, to_status, accrual)
+	SELECT accrual_order_id, NULLIF($2, ''), $3, accrual
+	FROM accruals
+	WHERE accrual_order_id = $1;
+	`
+	_, err := tx.ExecContext(ctx, query, accrualOrderID, from, to)
+	return err
+}
+
 func (db OrderStorage) UpdateAccrual(ctx context.Context, accrualOrderID int, accrual float64) error {
 	queryAccrual := `
 	UPDATE accruals
@@ -183,19 +403,45 @@ func (db OrderStorage) UpdateAccrual(ctx context.Context, accrualOrderID int, ac
 	return nil
 }
 
-func (db OrderStorage) GetOrders(ctx context.Context, userID int) ([]models.Accrual, error) {
+// returns a page of the user's orders sorted by (uploaded_at, accrual_order_id).
+// One extra row is fetched to find out whether there is a next page
+func (db OrderStorage) GetOrders(ctx context.Context, userID int, q database.OrdersQuery) ([]models.Accrual, *database.Cursor, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > database.MaxPageSize {
+		limit = database.DefaultPageSize
+	}
+
 	query := `
 	SELECT accrual_order_id, user_id, status, accrual, uploaded_at
 	FROM accruals
-	WHERE user_id = $1
-	ORDER BY uploaded_at ASC;
-	`
-	accruals := make([]models.Accrual, 0)
+	WHERE user_id = $1`
+	args := []any{userID}
 
-	rows, err := db.QueryContext(ctx, query, userID)
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if len(q.Statuses) > 0 {
+		query += " AND status = ANY(" + arg(q.Statuses) + ")"
+	}
+	if !q.From.IsZero() {
+		query += " AND uploaded_at >= " + arg(q.From)
+	}
+	if !q.To.IsZero() {
+		query += " AND uploaded_at < " + arg(q.To)
+	}
+	if q.After != nil {
+		query += " AND (uploaded_at, accrual_order_id) > (" + arg(q.After.UploadedAt) + ", " + arg(q.After.OrderID) + ")"
+	}
+	query += " ORDER BY uploaded_at ASC, accrual_order_id ASC LIMIT " + arg(limit+1) + ";"
+
+	accruals := make([]models.Accrual, 0, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		logger.Log.Error("query orders", zap.Error(err))
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
@@ -210,18 +456,104 @@ func (db OrderStorage) GetOrders(ctx context.Context, userID int) ([]models.Accr
 		)
 		if err != nil {
 			logger.Log.Error("scan rows", zap.Error(err))
+			return nil, nil, err
 		}
 		accruals = append(accruals, order)
 	}
 
 	if err := rows.Err(); err != nil {
 		logger.Log.Error("rows iteration error", zap.Error(err))
-		return nil, err
+		return nil, nil, err
 	}
 
-	return accruals, nil
+	if len(accruals) <= limit {
+		return accruals, nil, nil
+	}
+
+	accruals = accruals[:limit]
+	last := accruals[limit-1]
+	next := &database.Cursor{OrderID: last.AccrualOrderID}
+	if last.UploadTime != nil {
+		next.UploadedAt = *last.UploadTime
+	}
+
+	return accruals, next, nil
 }
 
+// returns database.ErrOrderNotFound for an unknown order
 func (db OrderStorage) GetOrder(ctx context.Context, accrualOrderID int) (*models.Accrual, error) {
-	return nil, nil
+	query := `
+	SELECT accrual_order_id, user_id, status, accrual, uploaded_at
+	FROM accruals
+	WHERE accrual_order_id = $1;
+	`
+
+	var order models.Accrual
+	err := db.QueryRowContext(ctx, query, accrualOrderID).Scan(
+		&order.AccrualOrderID,
+		&order.UserID,
+		&order.Status,
+		&order.Accrual,
+		&order.UploadTime,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, database.ErrOrderNotFound
+	}
+	if err != nil {
+		logger.Log.Error("get order", zap.Error(err))
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+// returns status changes of the order, oldest first. The order must belong to userID
+func (db OrderStorage) GetOrderHistory(ctx context.Context, accrualOrderID int, userID int) ([]models.StatusChange, error) {
+	queryOwner := `
+	SELECT user_id FROM accruals
+	WHERE accrual_order_id = $1;
+	`
+	queryHistory := `
+	SELECT COALESCE(from_status, ''), to_status, accrual, changed_at
+	FROM order_status_history
+	WHERE accrual_order_id = $1
+	ORDER BY id ASC;
+	`
+
+	var ownerID int
+	err := db.QueryRowContext(ctx, queryOwner, accrualOrderID).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, database.ErrOrderNotFound
+	}
+	if err != nil {
+		logger.Log.Error("get order owner", zap.Error(err))
+		return nil, err
+	}
+	if ownerID != userID {
+		return nil, database.ErrNotOrderOwner
+	}
+
+	rows, err := db.QueryContext(ctx, queryHistory, accrualOrderID)
+	if err != nil {
+		logger.Log.Error("query order history", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]models.StatusChange, 0)
+	for rows.Next() {
+		var change models.StatusChange
+		if err := rows.Scan(&change.From, &change.Status, &change.Accrual, &change.ChangedAt); err != nil {
+			logger.Log.Error("scan rows", zap.Error(err))
+			return nil, err
+		}
+		history = append(history, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return history, nil
 }
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+var ErrWebhookNotFound = errors.New("webhook subscription not found")
+
+// how long a claimed delivery stays hidden from other dispatchers
+const webhookLease = time.Minute
+
+// scans TEXT[] columns, database/sql has no array support of its own
+var typeMap = pgtype.NewMap()
+
+func (db OrderStorage) CreateWebhook(ctx context.Context, sub models.WebhookSubscription) (*models.WebhookSubscription, error) {
+	query := `
+	INSERT INTO webhook_subscriptions (user_id, url, event_types, secret)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at;
+	`
+
+	err := db.QueryRowContext(ctx, query, sub.UserID, sub.URL, sub.EventTypes, sub.Secret).
+		Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		logger.Log.Error("create webhook", zap.Error(err))
+		return nil, err
+	}
+
+	logger.Log.Info("webhook created", zap.Int64("id", sub.ID), zap.Int("user_id", sub.UserID))
+	return &sub, nil
+}
+
+// returns the user's subscriptions without their secrets
+func (db OrderStorage) Webhooks(ctx context.Context, userID int) ([]models.WebhookSubscription, error) {
+	query := `
+	SELECT id, user_id, url, event_types, created_at
+	FROM webhook_subscriptions
+	WHERE user_id = $1
+	ORDER BY id ASC;
+	`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		logger.Log.Error("query webhooks", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]models.WebhookSubscription, 0)
+	for rows.Next() {
+		var sub models.WebhookSubscription
+		err := rows.Scan(&sub.ID, &sub.UserID, &sub.URL, typeMap.SQLScanner(&sub.EventTypes), &sub.CreatedAt)
+		if err != nil {
+			logger.Log.Error("scan rows", zap.Error(err))
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// deletes the subscription together with its delivery log
+func (db OrderStorage) DeleteWebhook(ctx context.Context, id int64, userID int) error {
+	query := `
+	DELETE FROM webhook_subscriptions
+	WHERE id = $1 AND user_id = $2;
+	`
+
+	res, err := db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		logger.Log.Error("delete webhook", zap.Error(err))
+		return err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// returns the latest deliveries of the user's subscription, newest first
+func (db OrderStorage) WebhookDeliveries(ctx context.Context, id int64, userID int, limit int) ([]models.WebhookDelivery, error) {
+	queryOwner := `
+	SELECT 1 FROM webhook_subscriptions
+	WHERE id = $1 AND user_id = $2;
+	`
+	queryDeliveries := `
+	SELECT id, subscription_id, event_id, event_type, status, attempts,
+		COALESCE(response_status, 0), COALESCE(last_error, ''), created_at, delivered_at
+	FROM webhook_deliveries
+	WHERE subscription_id = $1
+	ORDER BY id DESC
+	LIMIT $2;
+	`
+
+	var exists int
+	err := db.QueryRowContext(ctx, queryOwner, id, userID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		logger.Log.Error("get webhook", zap.Error(err))
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, queryDeliveries, id, limit)
+	if err != nil {
+		logger.Log.Error("query webhook deliveries", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(
+			&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt,
+		)
+		if err != nil {
+			logger.Log.Error("scan rows", zap.Error(err))
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// creates a pending delivery of the event for every subscription of the user
+// listening to its type, returns how many were created
+func (db OrderStorage) EnqueueWebhookDeliveries(
+	ctx context.Context,
+	userID int,
+	eventID string,
+	eventType string,
+	payload []byte,
+) (int, error) {
+	query := `
+	INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload)
+	SELECT id, $2, $3, $4
+	FROM webhook_subscriptions
+	WHERE user_id = $1 AND $3 = ANY(event_types);
+	`
+
+	res, err := db.ExecContext(ctx, query, userID, eventID, eventType, payload)
+	if err != nil {
+		logger.Log.Error("enqueue webhook deliveries", zap.Error(err))
+		return 0, err
+	}
+
+	enqueued, err := res.RowsAffected()
+	return int(enqueued), err
+}
+
+// claims up to limit pending deliveries which are due. A claimed delivery isn't
+// handed out again until its lease runs out, so a crashed dispatcher only delays it
+func (db OrderStorage) ClaimWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+	query := `
+	UPDATE webhook_deliveries d
+	SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+	FROM webhook_subscriptions s
+	WHERE s.id = d.subscription_id AND d.id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.status,
+		d.attempts, d.created_at, s.url, s.secret;
+	`
+
+	rows, err := db.QueryContext(ctx, query, limit, webhookLease.Milliseconds())
+	if err != nil {
+		logger.Log.Error("claim webhook deliveries", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]models.WebhookDelivery, 0, limit)
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(
+			&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Payload, &d.Status,
+			&d.Attempts, &d.CreatedAt, &d.URL, &d.Secret,
+		)
+		if err != nil {
+			logger.Log.Error("scan rows", zap.Error(err))
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Log.Error("rows iteration error", zap.Error(err))
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// records one delivery attempt. A failed attempt is retried at nextAttempt,
+// when nextAttempt is nil the delivery is given up
+func (db OrderStorage) RecordWebhookAttempt(
+	ctx context.Context,
+	id int64,
+	responseStatus int,
+	deliveryErr error,
+	nextAttempt *time.Time,
+) error {
+	status := models.WebhookDelivered
+	lastError := ""
+	if deliveryErr != nil {
+		status = models.WebhookFailed
+		lastError = deliveryErr.Error()
+		if nextAttempt != nil {
+			status = models.WebhookPending
+		}
+	}
+
+	query := `
+	UPDATE webhook_deliveries
+	SET status = $2,
+		attempts = attempts + 1,
+		response_status = NULLIF($3, 0),
+		last_error = NULLIF($4, ''),
+		next_attempt_at = COALESCE($5, next_attempt_at),
+		delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() END
+	WHERE id = $1;
+	`
+
+	_, err := db.ExecContext(ctx, query, id, status, responseStatus, lastError, nextAttempt)
+	if err != nil {
+		logger.Log.Error("record webhook attempt", zap.Int64("id", id), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+)
+
+const (
+	accessTokenCookie  = "jwt_token"
+	refreshTokenCookie = "refresh_token"
+	// the refresh token is only sent to the endpoints which exchange it
+	refreshTokenPath = "/api/user/token"
+)
+
+// sets the access and refresh token cookies, both live as long as their tokens
+func setTokenCookies(c *gin.Context, token string, refreshToken string) {
+	c.SetCookie(
+		accessTokenCookie,
+		token,
+		int(flags.JWTTokenTTL.Seconds()),
+		"/",
+		"",
+		false,
+		true,
+	)
+
+	c.SetCookie(
+		refreshTokenCookie,
+		refreshToken,
+		int(flags.RefreshTokenTTL.Seconds()),
+		refreshTokenPath,
+		"",
+		false,
+		true,
+	)
+}
+
+func clearTokenCookies(c *gin.Context) {
+	c.SetCookie(accessTokenCookie, "", -1, "/", "", false, true)
+	c.SetCookie(refreshTokenCookie, "", -1, refreshTokenPath, "", false, true)
+}
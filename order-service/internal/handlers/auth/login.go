@@ -23,7 +23,7 @@ func Login(a *app.App) gin.HandlerFunc {
 			return
 		}
 
-		token, err := a.AuthClient.Login(context.Background(), creds.Login, creds.Password)
+		token, refreshToken, err := a.AuthClient.Login(context.Background(), creds.Login, creds.Password)
 		if err != nil {
 			if errors.Is(err, sso.ErrWrongPassword) {
 				logger.Log.Error("login", zap.Error(err))
@@ -35,15 +35,7 @@ func Login(a *app.App) gin.HandlerFunc {
 			return
 		}
 
-		c.SetCookie(
-			"jwt_token",
-			token,
-			3600,
-			"/",
-			"",
-			false,
-			true,
-		)
+		setTokenCookies(c, token, refreshToken)
 
 		c.String(http.StatusOK, "logged in successfully!")
 	}
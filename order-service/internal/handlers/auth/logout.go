@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/pkg/app"
+	sso "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Logout revokes the session of the jwt_token cookie and clears the token cookies
+func Logout(a *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(accessTokenCookie)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		err = a.AuthClient.Logout(context.Background(), token)
+		if err != nil {
+			if errors.Is(err, sso.ErrInvalidToken) {
+				logger.Log.Warn("logout", zap.Error(err))
+				clearTokenCookies(c)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			logger.Log.Error("logout", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		clearTokenCookies(c)
+
+		c.String(http.StatusOK, "logged out successfully!")
+	}
+}
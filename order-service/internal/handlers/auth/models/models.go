@@ -4,3 +4,22 @@ type Credentials struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
+
+// RefreshRequest is used by clients which don't keep the refresh token cookie
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type PasswordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordReset struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
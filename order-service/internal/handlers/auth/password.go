@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/paranoiachains/loyalty-api/order-service/internal/handlers/auth/models"
+	"github.com/paranoiachains/loyalty-api/pkg/app"
+	sso "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/middleware"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// ChangePassword requires the old password, the user's other sessions are logged out
+func ChangePassword(a *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req auth.PasswordChange
+
+		if err := c.ShouldBindJSON(&req); err != nil || req.NewPassword == "" {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		token, err := c.Cookie(accessTokenCookie)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		err = a.AuthClient.ChangePassword(context.Background(), token, req.OldPassword, req.NewPassword)
+		if err != nil {
+			if errors.Is(err, sso.ErrInvalidToken) {
+				logger.Log.Warn("change password", zap.Error(err))
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, sso.ErrWrongPassword) {
+				logger.Log.Warn("change password", zap.Error(err))
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			logger.Log.Error("change password", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.String(http.StatusOK, "password changed successfully!")
+	}
+}
+
+// RequestPasswordReset always answers 202, so it doesn't reveal which logins exist.
+// Requests over the limit of the client ip or the login are dropped silently.
+func RequestPasswordReset(a *app.App) gin.HandlerFunc {
+	byIP := middleware.NewLimiters(rate.Every(time.Minute), 5)
+	byLogin := middleware.NewLimiters(rate.Every(15*time.Minute), 3)
+
+	return func(c *gin.Context) {
+		var req auth.PasswordResetRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil || req.Login == "" {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if !byIP.Allow(c.ClientIP()) || !byLogin.Allow(req.Login) {
+			logger.Log.Warn("password reset request rate limited", zap.String("ip", c.ClientIP()))
+			c.String(http.StatusAccepted, "password reset requested")
+			return
+		}
+
+		err := a.AuthClient.RequestPasswordReset(context.Background(), req.Login)
+		if errors.Is(err, sso.ErrPasswordResetDisabled) {
+			c.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		// failures only happen for existing logins, reporting them would reveal the login
+		if err != nil {
+			logger.Log.Error("request password reset", zap.Error(err))
+		}
+
+		c.String(http.StatusAccepted, "password reset requested")
+	}
+}
+
+// ResetPassword sets a new password with a reset token, every session of the user is logged out
+func ResetPassword(a *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req auth.PasswordReset
+
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" || req.NewPassword == "" {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err := a.AuthClient.ResetPassword(context.Background(), req.Token, req.NewPassword)
+		if err != nil {
+			if errors.Is(err, sso.ErrInvalidResetToken) {
+				logger.Log.Warn("reset password", zap.Error(err))
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, sso.ErrPasswordResetDisabled) {
+				c.AbortWithStatus(http.StatusNotImplemented)
+				return
+			}
+			logger.Log.Error("reset password", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		clearTokenCookies(c)
+
+		c.String(http.StatusOK, "password reset successfully!")
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/paranoiachains/loyalty-api/order-service/internal/handlers/auth/models"
+	"github.com/paranoiachains/loyalty-api/pkg/app"
+	sso "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Refresh exchanges the refresh token, taken from its cookie or the request body,
+// for a new pair of tokens
+func Refresh(a *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		refreshToken, err := c.Cookie(refreshTokenCookie)
+		if err != nil || refreshToken == "" {
+			var req auth.RefreshRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				logger.Log.Error("json request", zap.Error(err))
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			refreshToken = req.RefreshToken
+		}
+
+		if refreshToken == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		token, newRefreshToken, err := a.AuthClient.Refresh(context.Background(), refreshToken)
+		if err != nil {
+			if errors.Is(err, sso.ErrInvalidRefreshToken) {
+				logger.Log.Warn("refresh token", zap.Error(err))
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			logger.Log.Error("refresh token", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		setTokenCookies(c, token, newRefreshToken)
+
+		c.String(http.StatusOK, "token refreshed successfully!")
+	}
+}
@@ -23,7 +23,7 @@ func Register(a *app.App) gin.HandlerFunc {
 			return
 		}
 
-		_, token, err := a.AuthClient.RegisterNewUser(context.Background(), creds.Login, creds.Password)
+		_, token, refreshToken, err := a.AuthClient.RegisterNewUser(context.Background(), creds.Login, creds.Password)
 		if err != nil {
 			if errors.Is(err, sso.ErrUserAlreadyExists) {
 				logger.Log.Error("register user", zap.Error(err))
@@ -35,15 +35,7 @@ func Register(a *app.App) gin.HandlerFunc {
 			return
 		}
 
-		c.SetCookie(
-			"jwt_token",
-			token,
-			3600,
-			"/",
-			"",
-			false,
-			true,
-		)
+		setTokenCookies(c, token, refreshToken)
 
 		c.String(http.StatusOK, "user registered successfully!")
 	}
@@ -58,6 +58,11 @@ func Withdraw(a *app.App) gin.HandlerFunc {
 				c.AbortWithStatus(http.StatusPaymentRequired)
 				return
 			}
+			if errors.Is(err, sso.ErrOrderAlreadyUsed) {
+				c.AbortWithStatus(http.StatusConflict)
+				return
+			}
+			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
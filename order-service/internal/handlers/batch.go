@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ShiraazMoollatjie/goluhn"
+	"github.com/gin-gonic/gin"
+
+	"github.com/paranoiachains/loyalty-api/pkg/app"
+	"github.com/paranoiachains/loyalty-api/pkg/database"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// order numbers accepted by one batch upload
+const maxBatchSize = 1000
+
+// results of a batch item
+const (
+	BatchAccepted    = "accepted"
+	BatchDuplicate   = "duplicate"
+	BatchAnotherUser = "another_user"
+	BatchInvalid     = "invalid"
+)
+
+var errBatchTooLarge = errors.New("batch is too large")
+
+type batchResult struct {
+	Order  string `json:"order"`
+	Result string `json:"result"`
+}
+
+// LoadOrders uploads up to maxBatchSize orders at once. The body is either a JSON
+// array of order numbers or one number per line. Valid orders are created in one tx,
+// the response holds a result for every uploaded number in the same order.
+func LoadOrders(app *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("userID")
+		if !ok {
+			logger.Log.Error("get user id gin")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		userID := value.(int64)
+
+		items, err := readBatch(c.Request.Body)
+		if errors.Is(err, errBatchTooLarge) {
+			c.String(http.StatusRequestEntityTooLarge, "at most %d orders per batch", maxBatchSize)
+			return
+		}
+		if err != nil {
+			logger.Log.Error("read batch", zap.Error(err))
+			c.String(http.StatusBadRequest, "body must be a JSON array or a newline-delimited list of order numbers")
+			return
+		}
+		if len(items) == 0 {
+			c.String(http.StatusBadRequest, "no orders in batch")
+			return
+		}
+
+		results := make([]batchResult, len(items))
+		valid := make([]int, 0, len(items))
+		// position of each valid order in results
+		positions := make([]int, 0, len(items))
+
+		for i, item := range items {
+			results[i] = batchResult{Order: item.number, Result: BatchInvalid}
+
+			if item.invalid {
+				continue
+			}
+			if err := goluhn.Validate(item.number); err != nil {
+				continue
+			}
+			accrualOrderID, err := strconv.Atoi(item.number)
+			if err != nil {
+				continue
+			}
+
+			valid = append(valid, accrualOrderID)
+			positions = append(positions, i)
+		}
+
+		if len(valid) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			created, err := app.DB.CreateAccruals(ctx, valid, int(userID))
+			if err != nil {
+				logger.Log.Error("create accruals", zap.Error(err))
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+
+			// order-created events of the new orders are published by the outbox relay
+			for j, err := range created {
+				result := &results[positions[j]]
+				switch {
+				case err == nil:
+					result.Result = BatchAccepted
+				case errors.Is(err, database.ErrAlreadyExists):
+					result.Result = BatchDuplicate
+				case errors.Is(err, database.ErrAnotherUser):
+					result.Result = BatchAnotherUser
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, results)
+	}
+}
+
+// an uploaded order number as the client sent it
+type batchItem struct {
+	number string
+	// JSON items other than strings and numbers are reported invalid
+	invalid bool
+}
+
+// parses a JSON array of strings or numbers, or a newline-delimited list
+func readBatch(body io.Reader) ([]batchItem, error) {
+	// generous for maxBatchSize numbers, anything longer is rejected unread
+	data, err := io.ReadAll(io.LimitReader(body, maxBatchSize*64+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBatchSize*64 {
+		return nil, errBatchTooLarge
+	}
+
+	var items []batchItem
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+		for _, item := range raw {
+			items = append(items, parseBatchItem(item))
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				items = append(items, batchItem{number: line})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(items) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+
+	return items, nil
+}
+
+func parseBatchItem(item json.RawMessage) batchItem {
+	// null unmarshals into a string without an error, so the JSON type is checked first
+	switch {
+	case len(item) > 0 && item[0] == '"':
+		var number string
+		if err := json.Unmarshal(item, &number); err == nil {
+			return batchItem{number: number}
+		}
+	case len(item) > 0 && (item[0] == '-' || (item[0] >= '0' && item[0] <= '9')):
+		var number json.Number
+		if err := json.Unmarshal(item, &number); err == nil {
+			return batchItem{number: number.String()}
+		}
+	}
+
+	// null, booleans, objects and arrays are echoed back as they were sent
+	return batchItem{number: string(item), invalid: true}
+}
@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ShiraazMoollatjie/goluhn"
@@ -70,21 +72,117 @@ func LoadOrder(app *app.App) gin.HandlerFunc {
 			return
 		}
 
+		// order-created event is published by the outbox relay
+		logger.Log.Info("accrual created", zap.Int("order_id", order.AccrualOrderID))
 		c.String(http.StatusAccepted, "accrual instance created!")
+	}
+}
+
+// GetOrders returns a page of the user's orders. Query parameters:
+// status (repeatable or comma separated), from and to (RFC 3339 or YYYY-MM-DD),
+// limit and cursor. The next page is announced by X-Next-Cursor and Link headers.
+func GetOrders(app *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("userID")
+		if !ok {
+			logger.Log.Error("get user id gin")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		userID := value.(int64)
+
+		query, err := ordersQuery(c)
+		if err != nil {
+			logger.Log.Warn("orders query", zap.Error(err))
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 
-		logger.Log.Info("marshalling order...")
-		data, err := json.Marshal(&order)
+		orders, next, err := app.DB.GetOrders(context.Background(), int(userID), query)
 		if err != nil {
-			logger.Log.Error("marshal accrual struct", zap.Error(err))
+			logger.Log.Error("get orders", zap.Error(err))
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		app.Kafka.Send(data)
+		if len(orders) == 0 {
+			c.String(http.StatusNoContent, "no orders")
+			return
+		}
+
+		if next != nil {
+			cursor := next.Encode()
+
+			nextURL := *c.Request.URL
+			params := nextURL.Query()
+			params.Set("cursor", cursor)
+			nextURL.RawQuery = params.Encode()
+
+			c.Header("X-Next-Cursor", cursor)
+			c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.RequestURI()))
+		}
+
+		c.JSON(http.StatusOK, orders)
 	}
 }
 
-func GetOrders(app *app.App) gin.HandlerFunc {
+// parses pagination and filter parameters of GetOrders
+func ordersQuery(c *gin.Context) (database.OrdersQuery, error) {
+	query := database.OrdersQuery{Limit: database.DefaultPageSize}
+
+	for _, param := range c.QueryArray("status") {
+		for _, status := range strings.Split(param, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if status == "" {
+				continue
+			}
+			if !database.ValidStatus(status) {
+				return query, fmt.Errorf("unknown status %q", status)
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+
+	var err error
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseDate(from); err != nil {
+			return query, fmt.Errorf("invalid from date: %w", err)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseDate(to); err != nil {
+			return query, fmt.Errorf("invalid to date: %w", err)
+		}
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", database.MaxPageSize)
+		}
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := database.DecodeCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.After = &after
+	}
+
+	return query, nil
+}
+
+// accepts RFC 3339 timestamps and plain dates. Timestamps are stored without a time zone in UTC
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func GetOrder(app *app.App) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		value, ok := c.Get("userID")
 		if !ok {
@@ -95,17 +193,72 @@ func GetOrders(app *app.App) gin.HandlerFunc {
 
 		userID := value.(int64)
 
-		orders, err := app.DB.GetOrders(context.Background(), int(userID))
+		accrualOrderID, err := strconv.Atoi(c.Param("number"))
 		if err != nil {
-			logger.Log.Error("get orders", zap.Error(err))
+			logger.Log.Error("conv order number to int", zap.Error(err))
+			c.String(http.StatusBadRequest, "invalid order number")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		order, err := app.DB.GetOrder(ctx, accrualOrderID)
+		if errors.Is(err, database.ErrOrderNotFound) {
+			c.String(http.StatusNotFound, "order not found")
+			return
+		}
+		if err != nil {
+			logger.Log.Error("get order", zap.Error(err))
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		if len(orders) == 0 {
-			c.String(http.StatusNoContent, "no orders")
+		if order.UserID != int(userID) {
+			c.String(http.StatusForbidden, "order was uploaded by another user")
+			return
 		}
 
-		c.JSON(http.StatusOK, orders)
+		c.JSON(http.StatusOK, order)
+	}
+}
+
+func OrderHistory(app *app.App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("userID")
+		if !ok {
+			logger.Log.Error("get user id gin")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		userID := value.(int64)
+
+		accrualOrderID, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			logger.Log.Error("conv order number to int", zap.Error(err))
+			c.String(http.StatusBadRequest, "invalid order number")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		history, err := app.DB.GetOrderHistory(ctx, accrualOrderID, int(userID))
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrOrderNotFound):
+				c.String(http.StatusNotFound, "order not found")
+				return
+			case errors.Is(err, database.ErrNotOrderOwner):
+				c.String(http.StatusForbidden, "order was uploaded by another user")
+				return
+			}
+			logger.Log.Error("get order history", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, history)
 	}
 }
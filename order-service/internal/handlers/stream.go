@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/stream"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// keeps idle connections from being closed by proxies
+const streamHeartbeat = 15 * time.Second
+
+// StreamOrders pushes status and accrual updates of the user's orders as server-sent events
+func StreamOrders(hub *stream.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("userID")
+		if !ok {
+			logger.Log.Error("get user id gin")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		userID := value.(int64)
+
+		updates, unsubscribe := hub.Subscribe(int(userID))
+		defer unsubscribe()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		logger.Log.Info("order stream opened", zap.Int64("user_id", userID))
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case order, ok := <-updates:
+				if !ok {
+					return false
+				}
+				c.SSEvent("order", order)
+				return true
+			case <-heartbeat.C:
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				return err == nil
+			}
+		})
+
+		logger.Log.Info("order stream closed", zap.Int64("user_id", userID))
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/database"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/webhooks"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+// deliveries returned by the delivery log
+const deliveryLogLimit = 100
+
+// CreateWebhook subscribes a URL to events of the user. The secret is
+// generated unless given and is only returned in this response.
+func CreateWebhook(store webhooks.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("userID")
+		userID := value.(int64)
+
+		request := struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+			Secret string   `json:"secret"`
+		}{}
+
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.Log.Error("json request", zap.Error(err))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		target, err := url.Parse(request.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.String(http.StatusBadRequest, "url must be an absolute http(s) url")
+			return
+		}
+		// hosts are checked again on every delivery, once they are resolved
+		if ip := net.ParseIP(target.Hostname()); target.Hostname() == "localhost" || (ip != nil && !webhooks.AllowedIP(ip)) {
+			c.String(http.StatusBadRequest, "url must not point to an internal address")
+			return
+		}
+
+		if len(request.Events) == 0 {
+			c.String(http.StatusBadRequest, "events list is required")
+			return
+		}
+		for _, event := range request.Events {
+			if !webhooks.ValidEventType(event) {
+				c.String(http.StatusBadRequest, "unknown event type "+strconv.Quote(event))
+				return
+			}
+		}
+
+		if request.Secret == "" {
+			request.Secret = webhooks.NewSecret()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sub, err := store.CreateWebhook(ctx, models.WebhookSubscription{
+			UserID:     int(userID),
+			URL:        target.String(),
+			EventTypes: request.Events,
+			Secret:     request.Secret,
+		})
+		if err != nil {
+			logger.Log.Error("create webhook", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusCreated, sub)
+	}
+}
+
+func GetWebhooks(store webhooks.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("userID")
+		userID := value.(int64)
+
+		subs, err := store.Webhooks(context.Background(), int(userID))
+		if err != nil {
+			logger.Log.Error("get webhooks", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if len(subs) == 0 {
+			c.String(http.StatusNoContent, "no webhooks")
+			return
+		}
+
+		c.JSON(http.StatusOK, subs)
+	}
+}
+
+func DeleteWebhook(store webhooks.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("userID")
+		userID := value.(int64)
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid webhook id")
+			return
+		}
+
+		err = store.DeleteWebhook(context.Background(), id, int(userID))
+		if errors.Is(err, database.ErrWebhookNotFound) {
+			c.String(http.StatusNotFound, "webhook not found")
+			return
+		}
+		if err != nil {
+			logger.Log.Error("delete webhook", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// WebhookDeliveries returns the delivery log of a subscription, newest first
+func WebhookDeliveries(store webhooks.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("userID")
+		userID := value.(int64)
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid webhook id")
+			return
+		}
+
+		deliveries, err := store.WebhookDeliveries(context.Background(), id, int(userID), deliveryLogLimit)
+		if errors.Is(err, database.ErrWebhookNotFound) {
+			c.String(http.StatusNotFound, "webhook not found")
+			return
+		}
+		if err != nil {
+			logger.Log.Error("get webhook deliveries", zap.Error(err))
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
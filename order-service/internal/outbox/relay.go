@@ -0,0 +1,76 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+// Storage must be implemented by the database holding the outbox table
+type Storage interface {
+	PublishPending(
+		ctx context.Context,
+		topic string,
+		limit int,
+		publish func([]models.OutboxMessage) error,
+	) (int, error)
+}
+
+// Relay periodically publishes pending outbox rows of one topic to the broker, a batch
+// of rows in a single write. Rows are marked sent only after the broker acknowledged
+// them, so delivery is at-least-once.
+type Relay struct {
+	DB Storage
+	// logical topic the rows were enqueued with
+	Topic string
+	// topic the rows are published to
+	Destination string
+	Publisher   messaging.BatchPublisher
+	Interval    time.Duration
+	BatchSize   int
+}
+
+func (r Relay) Run(ctx context.Context) {
+	logger.Log.Info("outbox relay started!", zap.String("topic", r.Topic))
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log.Info("outbox relay stopped", zap.String("topic", r.Topic))
+			return
+		case <-ticker.C:
+			r.flush(ctx)
+		}
+	}
+}
+
+// publishes batches until the outbox has no more pending rows
+func (r Relay) flush(ctx context.Context) {
+	for {
+		// a failed publish leaves the whole batch pending
+		sent, err := r.DB.PublishPending(ctx, r.Topic, r.BatchSize, func(msgs []models.OutboxMessage) error {
+			records := make([]messaging.Record, 0, len(msgs))
+			for _, msg := range msgs {
+				records = append(records, messaging.Record{Key: msg.Key, Value: msg.Payload})
+			}
+			return r.Publisher.PublishBatch(ctx, r.Destination, records)
+		})
+		if err != nil {
+			logger.Log.Error("publish pending outbox messages", zap.Error(err))
+			return
+		}
+		if sent > 0 {
+			logger.Log.Info("outbox messages published", zap.String("topic", r.Topic), zap.Int("count", sent))
+		}
+		if sent < r.BatchSize || ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+)
+
+// memStorage claims pending rows in id order like the outbox table does
+type memStorage struct {
+	mu   sync.Mutex
+	rows []models.OutboxMessage
+	sent map[int64]bool
+}
+
+func newMemStorage(topic string, count int) *memStorage {
+	s := &memStorage{sent: make(map[int64]bool)}
+	for i := 1; i <= count; i++ {
+		s.rows = append(s.rows, models.OutboxMessage{
+			ID:      int64(i),
+			Topic:   topic,
+			Key:     strconv.Itoa(i),
+			Payload: []byte(`{"n":` + strconv.Itoa(i) + `}`),
+		})
+	}
+	return s
+}
+
+func (s *memStorage) PublishPending(
+	ctx context.Context,
+	topic string,
+	limit int,
+	publish func([]models.OutboxMessage) error,
+) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []models.OutboxMessage
+	for _, row := range s.rows {
+		if row.Topic == topic && !s.sent[row.ID] && len(claimed) < limit {
+			claimed = append(claimed, row)
+		}
+	}
+	if len(claimed) == 0 {
+		return 0, nil
+	}
+
+	if err := publish(claimed); err != nil {
+		return 0, err
+	}
+	for _, row := range claimed {
+		s.sent[row.ID] = true
+	}
+	return len(claimed), nil
+}
+
+func (s *memStorage) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.rows) - len(s.sent)
+}
+
+type batchPublisher struct {
+	fail    error
+	topics  []string
+	batches [][]messaging.Record
+}
+
+func (p *batchPublisher) Publish(ctx context.Context, topic string, key string, msg []byte) error {
+	return p.PublishBatch(ctx, topic, []messaging.Record{{Key: key, Value: msg}})
+}
+
+func (p *batchPublisher) PublishBatch(ctx context.Context, topic string, records []messaging.Record) error {
+	if p.fail != nil {
+		return p.fail
+	}
+	p.topics = append(p.topics, topic)
+	p.batches = append(p.batches, records)
+	return nil
+}
+
+func TestRelayPublishesBatches(t *testing.T) {
+	db := newMemStorage(messaging.TopicOrderCreated, 25)
+	publisher := &batchPublisher{}
+	relay := Relay{
+		DB:          db,
+		Topic:       messaging.TopicOrderCreated,
+		Destination: "orders",
+		Publisher:   publisher,
+		BatchSize:   10,
+	}
+
+	relay.flush(context.Background())
+
+	// one write per claimed batch, not one per row
+	wantSizes := []int{10, 10, 5}
+	if len(publisher.batches) != len(wantSizes) {
+		t.Fatalf("%d writes, want %d", len(publisher.batches), len(wantSizes))
+	}
+
+	next := 1
+	for i, batch := range publisher.batches {
+		if len(batch) != wantSizes[i] {
+			t.Errorf("batch %d has %d records, want %d", i, len(batch), wantSizes[i])
+		}
+		if publisher.topics[i] != relay.Destination {
+			t.Errorf("batch %d published to %q, want %q", i, publisher.topics[i], relay.Destination)
+		}
+		for _, record := range batch {
+			if record.Key != strconv.Itoa(next) {
+				t.Errorf("record key = %s, want %d", record.Key, next)
+			}
+			next++
+		}
+	}
+
+	if pending := db.pending(); pending != 0 {
+		t.Errorf("%d rows still pending", pending)
+	}
+}
+
+func TestRelayKeepsFailedBatchPending(t *testing.T) {
+	db := newMemStorage(messaging.TopicOrderCreated, 5)
+	publisher := &batchPublisher{fail: errors.New("broker unavailable")}
+	relay := Relay{
+		DB:          db,
+		Topic:       messaging.TopicOrderCreated,
+		Destination: "orders",
+		Publisher:   publisher,
+		BatchSize:   10,
+	}
+
+	relay.flush(context.Background())
+	if pending := db.pending(); pending != 5 {
+		t.Fatalf("%d rows pending after a failed write, want 5", pending)
+	}
+
+	publisher.fail = nil
+	relay.flush(context.Background())
+	if pending := db.pending(); pending != 0 {
+		t.Errorf("%d rows pending after the retry, want 0", pending)
+	}
+	if len(publisher.batches) != 1 || len(publisher.batches[0]) != 5 {
+		t.Errorf("retry wrote %d batches, want one batch of 5", len(publisher.batches))
+	}
+}
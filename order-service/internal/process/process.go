@@ -2,9 +2,8 @@ package process
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 
-	ssowithdraw "github.com/paranoiachains/loyalty-api/pkg/clients/sso/withdraw"
 	"github.com/paranoiachains/loyalty-api/pkg/database"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"github.com/paranoiachains/loyalty-api/pkg/messaging"
@@ -12,11 +11,32 @@ import (
 	"go.uber.org/zap"
 )
 
+// UpdatePublisher receives every order change the processor applies
+type UpdatePublisher interface {
+	Publish(order models.Accrual)
+}
+
+// TopUpClient credits accruals to users, implemented by the sso withdrawals client.
+// Applied is false if the order had been credited before.
+type TopUpClient interface {
+	TopUp(ctx context.Context, order int64, userID int64, sum float64) (applied bool, err error)
+}
+
+// Notifier delivers events to the webhooks of a user
+type Notifier interface {
+	Notify(ctx context.Context, userID int, eventType string, data any) error
+}
+
 type OrderProcessor struct {
 	DB             database.Storage
 	Broker         messaging.MessageBroker
 	StatusBroker   messaging.MessageBroker
-	WithdrawClient *ssowithdraw.WithdrawalsClient
+	WithdrawClient TopUpClient
+	Topics         messaging.Topics
+	DeadLetters    messaging.Publisher
+	Retry          messaging.RetryPolicy
+	Updates        UpdatePublisher
+	Webhooks       Notifier
 }
 
 func (p OrderProcessor) Process(ctx context.Context) {
@@ -27,54 +47,146 @@ func (p OrderProcessor) Process(ctx context.Context) {
 
 	for {
 		select {
-		case data, ok := <-brokerCh:
+		case msg, ok := <-brokerCh:
 			if !ok {
 				logger.Log.Warn("broker channel closed")
 				return
 			}
-			var order models.Accrual
-			logger.Log.Info("unmarshalling order...")
-			err := json.Unmarshal(data, &order)
-			if err != nil {
-				logger.Log.Error("unmarshal order", zap.Error(err))
-				continue
-			}
-
-			err = p.DB.UpdateAccrual(ctx, order.AccrualOrderID, order.Accrual)
-			if err != nil {
-				logger.Log.Error("update accrual", zap.Error(err))
-				continue
-			}
-
-			logger.Log.Info("sending a top up request", zap.Int("user_id", order.UserID), zap.Float64("sum", order.Accrual))
-			err = p.WithdrawClient.TopUp(ctx, int64(order.UserID), order.Accrual)
+			err := messaging.Handle(ctx, p.Retry, p.DeadLetters, p.Topics.OrderCompleted, msg, p.completeOrder)
 			if err != nil {
-				logger.Log.Error("process top up call", zap.Error(err))
+				logger.Log.Error("handle completed order", zap.Error(err))
+				msg.Nack()
 				continue
 			}
-		case data, ok := <-statusCh:
+			msg.Ack()
+		case msg, ok := <-statusCh:
 			if !ok {
 				logger.Log.Warn("status broker channel closed")
 				return
 			}
-			var statusUpdate models.AccrualStatusUpdate
-			logger.Log.Info("unmarshalling status update...")
-			err := json.Unmarshal(data, &statusUpdate)
+			err := messaging.Handle(ctx, p.Retry, p.DeadLetters, p.Topics.OrderStatus, msg, p.updateStatus)
 			if err != nil {
-				logger.Log.Error("unmarshal status update", zap.Error(err))
+				logger.Log.Error("handle status update", zap.Error(err))
+				msg.Nack()
 				continue
 			}
+			msg.Ack()
+		}
+	}
+}
 
-			logger.Log.Info("status update received",
-				zap.Int("order_id", statusUpdate.OrderID),
-				zap.String("status", statusUpdate.Status),
-			)
+// stores the evaluated accrual and credits it to the user
+func (p OrderProcessor) completeOrder(ctx context.Context, data []byte) error {
+	var order models.Accrual
+	logger.Log.Info("unmarshalling order...")
+	_, err := messaging.Unmarshal(data, messaging.EventOrderCompleted, &order)
+	if err != nil {
+		logger.Log.Error("unmarshal order", zap.Error(err))
+		return messaging.Permanent(err)
+	}
 
-			err = p.DB.SetStatus(ctx, statusUpdate.OrderID, statusUpdate.Status)
-			if err != nil {
-				logger.Log.Error("set status", zap.Error(err))
-				continue
-			}
-		}
+	err = p.DB.UpdateAccrual(ctx, order.AccrualOrderID, order.Accrual)
+	if err != nil {
+		logger.Log.Error("update accrual", zap.Error(err))
+		return err
+	}
+
+	logger.Log.Info("sending a top up request", zap.Int("user_id", order.UserID), zap.Float64("sum", order.Accrual))
+	applied, err := p.WithdrawClient.TopUp(ctx, int64(order.AccrualOrderID), int64(order.UserID), order.Accrual)
+	if err != nil {
+		logger.Log.Error("process top up call", zap.Error(err))
+		return err
+	}
+	if !applied {
+		logger.Log.Warn("order already credited, skipping duplicate", zap.Int("order_id", order.AccrualOrderID))
+		return nil
+	}
+	logger.Log.Info("order credited", zap.Int("order_id", order.AccrualOrderID))
+
+	p.publishUpdate(ctx, order.AccrualOrderID, "")
+	p.notify(ctx, order.UserID, messaging.EventBalanceToppedUp, models.BalanceTopUp{
+		OrderID: order.AccrualOrderID,
+		UserID:  order.UserID,
+		Sum:     order.Accrual,
+	})
+
+	return nil
+}
+
+func (p OrderProcessor) updateStatus(ctx context.Context, data []byte) error {
+	var statusUpdate models.AccrualStatusUpdate
+	logger.Log.Info("unmarshalling status update...")
+	_, err := messaging.Unmarshal(data, messaging.EventOrderStatus, &statusUpdate)
+	if err != nil {
+		logger.Log.Error("unmarshal status update", zap.Error(err))
+		return messaging.Permanent(err)
+	}
+
+	logger.Log.Info("status update received",
+		zap.Int("order_id", statusUpdate.OrderID),
+		zap.String("status", statusUpdate.Status),
+	)
+
+	// the accrual is only stored along with a valid transition, a refused update leaves it as is
+	if statusUpdate.Accrual > 0 {
+		err = p.DB.SetStatusWithAccrual(ctx, statusUpdate.OrderID, statusUpdate.Status, statusUpdate.Accrual)
+	} else {
+		err = p.DB.SetStatus(ctx, statusUpdate.OrderID, statusUpdate.Status)
+	}
+	if errors.Is(err, database.ErrStatusRegression) {
+		// a stale update, the order already moved past this status
+		logger.Log.Warn("status regression refused",
+			zap.Int("order_id", statusUpdate.OrderID),
+			zap.String("status", statusUpdate.Status))
+		return nil
+	}
+	if errors.Is(err, database.ErrIllegalTransition) || errors.Is(err, database.ErrUnknownStatus) {
+		// retrying won't make the transition legal
+		logger.Log.Error("set status", zap.Error(err))
+		return messaging.Permanent(err)
+	}
+	if err != nil {
+		logger.Log.Error("set status", zap.Error(err))
+		return err
+	}
+
+	p.publishUpdate(ctx, statusUpdate.OrderID, messaging.EventOrderStatus)
+
+	return nil
+}
+
+// hands the stored order to stream subscribers of its owner and, unless eventType
+// is empty, to the owner's webhooks. The update is best-effort, a failed lookup
+// doesn't fail the message
+func (p OrderProcessor) publishUpdate(ctx context.Context, accrualOrderID int, eventType string) {
+	if p.Updates == nil && (p.Webhooks == nil || eventType == "") {
+		return
+	}
+
+	order, err := p.DB.GetOrder(ctx, accrualOrderID)
+	if err != nil {
+		logger.Log.Warn("get order for update", zap.Int("order_id", accrualOrderID), zap.Error(err))
+		return
+	}
+
+	if p.Updates != nil {
+		p.Updates.Publish(*order)
+	}
+	if eventType != "" {
+		p.notify(ctx, order.UserID, eventType, order)
+	}
+}
+
+// webhooks are best-effort as well, the processed message isn't retried for them
+func (p OrderProcessor) notify(ctx context.Context, userID int, eventType string, data any) {
+	if p.Webhooks == nil {
+		return
+	}
+
+	if err := p.Webhooks.Notify(ctx, userID, eventType, data); err != nil {
+		logger.Log.Error("notify webhooks",
+			zap.Int("user_id", userID),
+			zap.String("event_type", eventType),
+			zap.Error(err))
 	}
 }
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/app"
 	"github.com/paranoiachains/loyalty-api/order-service/internal/handlers"
 	"github.com/paranoiachains/loyalty-api/order-service/internal/handlers/auth"
-	"github.com/paranoiachains/loyalty-api/pkg/app"
 	"github.com/paranoiachains/loyalty-api/pkg/middleware"
 )
 
@@ -14,24 +18,56 @@ type Server struct {
 
 func New(a *app.App) *Server {
 	r := gin.New()
+	// the service is reached directly, forwarded-for headers would let clients pick
+	// the ip per-ip rate limits are counted against
+	r.SetTrustedProxies(nil)
 	r.Use(gin.Recovery(), middleware.Logger(), middleware.Compression())
 
-	r.POST("/api/user/register", auth.Register(a))
-	r.POST("/api/user/login", auth.Login(a))
+	r.POST("/api/user/register", auth.Register(a.App))
+	r.POST("/api/user/login", auth.Login(a.App))
+	r.POST("/api/user/token/refresh", auth.Refresh(a.App))
+	r.POST("/api/user/password/reset-request", auth.RequestPasswordReset(a.App))
+	r.POST("/api/user/password/reset", auth.ResetPassword(a.App))
 
 	authGroup := r.Group("/")
-	authGroup.Use(middleware.Auth())
+	authGroup.Use(middleware.Auth(a.TokenKeys, a.Revoked))
 	{
-		authGroup.POST("/api/user/orders", handlers.LoadOrder(a))
-		authGroup.GET("/api/user/orders", handlers.GetOrders(a))
-		authGroup.GET("/api/user/balance", handlers.Balance(a))
-		authGroup.POST("/api/user/balance/withdraw", handlers.Withdraw(a))
-		authGroup.GET("/api/user/withdrawals", handlers.Withdrawals(a))
+		authGroup.POST("/api/user/logout", auth.Logout(a.App))
+		authGroup.POST("/api/user/password", auth.ChangePassword(a.App))
+		authGroup.POST("/api/user/orders", handlers.LoadOrder(a.App))
+		authGroup.GET("/api/user/orders", handlers.GetOrders(a.App))
+		authGroup.POST("/api/user/orders/batch", handlers.LoadOrders(a.App))
+		authGroup.GET("/api/user/orders/stream", handlers.StreamOrders(a.Updates))
+		authGroup.GET("/api/user/orders/:number", handlers.GetOrder(a.App))
+		authGroup.GET("/api/user/orders/:number/history", handlers.OrderHistory(a.App))
+		authGroup.GET("/api/user/balance", handlers.Balance(a.App))
+		authGroup.POST("/api/user/balance/withdraw", handlers.Withdraw(a.App))
+		authGroup.GET("/api/user/withdrawals", handlers.Withdrawals(a.App))
+		authGroup.POST("/api/user/webhooks", handlers.CreateWebhook(a.Webhooks))
+		authGroup.GET("/api/user/webhooks", handlers.GetWebhooks(a.Webhooks))
+		authGroup.DELETE("/api/user/webhooks/:id", handlers.DeleteWebhook(a.Webhooks))
+		authGroup.GET("/api/user/webhooks/:id/deliveries", handlers.WebhookDeliveries(a.Webhooks))
 	}
 
 	return &Server{engine: r}
 }
 
-func (s *Server) Run(addr string) error {
-	return s.engine.Run(addr)
+// Run serves on addr until ctx is done, then waits for the in-flight requests
+func (s *Server) Run(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.engine}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"sync"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+// updates buffered per subscription before new ones are dropped
+const subscriptionBuffer = 16
+
+// Hub fans order updates out to every open subscription of the order's owner.
+// It lives in process memory, so a client only sees updates consumed by the
+// instance it is connected to.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan models.Accrual]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[int]map[chan models.Accrual]struct{})}
+}
+
+// Subscribe returns the user's updates and a function which has to be called
+// once the subscriber is gone
+func (h *Hub) Subscribe(userID int) (<-chan models.Accrual, func()) {
+	ch := make(chan models.Accrual, subscriptionBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan models.Accrual]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			delete(h.subscribers[userID], ch)
+			if len(h.subscribers[userID]) == 0 {
+				delete(h.subscribers, userID)
+			}
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish never blocks the processor: a subscriber whose buffer is full misses the update
+func (h *Hub) Publish(order models.Accrual) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[order.UserID] {
+		select {
+		case ch <- order:
+		default:
+			logger.Log.Warn("order update dropped, subscriber is too slow",
+				zap.Int("user_id", order.UserID),
+				zap.Int("order_id", order.AccrualOrderID))
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+// event types a subscription can listen to
+var EventTypes = []string{
+	messaging.EventOrderStatus,
+	messaging.EventBalanceToppedUp,
+}
+
+// headers of a delivery request
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderID        = "X-Webhook-ID"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Storage must be implemented by the database holding subscriptions and the delivery log
+type Storage interface {
+	CreateWebhook(ctx context.Context, sub models.WebhookSubscription) (*models.WebhookSubscription, error)
+	Webhooks(ctx context.Context, userID int) ([]models.WebhookSubscription, error)
+	DeleteWebhook(ctx context.Context, id int64, userID int) error
+	WebhookDeliveries(ctx context.Context, id int64, userID int, limit int) ([]models.WebhookDelivery, error)
+	EnqueueWebhookDeliveries(ctx context.Context, userID int, eventID, eventType string, payload []byte) (int, error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, id int64, responseStatus int, deliveryErr error, nextAttempt *time.Time) error
+}
+
+func ValidEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret generates a signing secret for a subscription which didn't bring its own
+func NewSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the signature of a delivery: hex HMAC-SHA256 of "<timestamp>.<body>".
+// Receivers recompute it with their secret and compare it to the X-Webhook-Signature header.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher stores events for the subscriptions listening to them and delivers
+// them in the background. Deliveries are retried with backoff according to Retry.
+type Dispatcher struct {
+	DB        Storage
+	Client    *http.Client
+	Retry     messaging.RetryPolicy
+	Interval  time.Duration
+	BatchSize int
+}
+
+// Notify records the event for every subscription of the user listening to eventType.
+// The body of a delivery is the event envelope.
+func (d Dispatcher) Notify(ctx context.Context, userID int, eventType string, data any) error {
+	env, err := messaging.NewEnvelope(eventType, messaging.ProducerOrderService, data)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	enqueued, err := d.DB.EnqueueWebhookDeliveries(ctx, userID, env.EventID, eventType, payload)
+	if err != nil {
+		return err
+	}
+	if enqueued > 0 {
+		logger.Log.Info("webhook deliveries enqueued",
+			zap.String("event_type", eventType),
+			zap.Int("user_id", userID),
+			zap.Int("count", enqueued))
+	}
+
+	return nil
+}
+
+func (d Dispatcher) Run(ctx context.Context) {
+	logger.Log.Info("webhook dispatcher started!")
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log.Info("webhook dispatcher stopped")
+			return
+		case <-ticker.C:
+			d.flush(ctx)
+		}
+	}
+}
+
+// delivers batches until no due deliveries are left
+func (d Dispatcher) flush(ctx context.Context) {
+	for {
+		deliveries, err := d.DB.ClaimWebhookDeliveries(ctx, d.BatchSize)
+		if err != nil {
+			logger.Log.Error("claim webhook deliveries", zap.Error(err))
+			return
+		}
+
+		for _, delivery := range deliveries {
+			d.attempt(ctx, delivery)
+		}
+
+		if len(deliveries) < d.BatchSize {
+			return
+		}
+	}
+}
+
+func (d Dispatcher) attempt(ctx context.Context, delivery models.WebhookDelivery) {
+	attempt := delivery.Attempts + 1
+	responseStatus, err := d.deliver(ctx, delivery)
+
+	var nextAttempt *time.Time
+	if err != nil {
+		logger.Log.Warn("webhook delivery failed",
+			zap.Int64("delivery_id", delivery.ID),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+
+		if attempt < max(d.Retry.Attempts, 1) {
+			next := time.Now().Add(d.backoff(attempt))
+			nextAttempt = &next
+		}
+	}
+
+	if err := d.DB.RecordWebhookAttempt(ctx, delivery.ID, responseStatus, err, nextAttempt); err != nil {
+		logger.Log.Error("record webhook attempt", zap.Int64("delivery_id", delivery.ID), zap.Error(err))
+	}
+}
+
+// sends one signed delivery, any response other than 2xx is a failure
+func (d Dispatcher) deliver(ctx context.Context, delivery models.WebhookDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderID, delivery.EventID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// delay before the attempt following the given one, doubling like RetryPolicy.Do
+func (d Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.Retry.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if d.Retry.MaxBackoff > 0 && backoff >= d.Retry.MaxBackoff {
+			return d.Retry.MaxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,235 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+)
+
+// memStorage keeps deliveries in memory, due times are ignored so every
+// pending delivery is claimed by the next flush
+type memStorage struct {
+	mu         sync.Mutex
+	deliveries map[int64]*models.WebhookDelivery
+	next       map[int64][]time.Time
+}
+
+func newMemStorage(deliveries ...models.WebhookDelivery) *memStorage {
+	s := &memStorage{
+		deliveries: make(map[int64]*models.WebhookDelivery),
+		next:       make(map[int64][]time.Time),
+	}
+	for _, d := range deliveries {
+		d.Status = models.WebhookPending
+		s.deliveries[d.ID] = &d
+	}
+	return s
+}
+
+func (s *memStorage) CreateWebhook(ctx context.Context, sub models.WebhookSubscription) (*models.WebhookSubscription, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *memStorage) Webhooks(ctx context.Context, userID int) ([]models.WebhookSubscription, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *memStorage) DeleteWebhook(ctx context.Context, id int64, userID int) error {
+	return errors.New("not implemented")
+}
+
+func (s *memStorage) WebhookDeliveries(ctx context.Context, id int64, userID int, limit int) ([]models.WebhookDelivery, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *memStorage) EnqueueWebhookDeliveries(ctx context.Context, userID int, eventID, eventType string, payload []byte) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (s *memStorage) ClaimWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []models.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.Status == models.WebhookPending && len(claimed) < limit {
+			claimed = append(claimed, *d)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memStorage) RecordWebhookAttempt(ctx context.Context, id int64, responseStatus int, deliveryErr error, nextAttempt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.deliveries[id]
+	d.Attempts++
+	d.ResponseStatus = responseStatus
+	switch {
+	case deliveryErr == nil:
+		d.Status = models.WebhookDelivered
+	case nextAttempt != nil:
+		d.Status = models.WebhookPending
+		d.LastError = deliveryErr.Error()
+		s.next[id] = append(s.next[id], *nextAttempt)
+	default:
+		d.Status = models.WebhookFailed
+		d.LastError = deliveryErr.Error()
+	}
+	return nil
+}
+
+func (s *memStorage) delivery(id int64) models.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.deliveries[id]
+}
+
+func testDelivery(url string) models.WebhookDelivery {
+	return models.WebhookDelivery{
+		ID:        1,
+		EventID:   "event-1",
+		EventType: messaging.EventOrderStatus,
+		Payload:   []byte(`{"event_type":"order.status_updated"}`),
+		URL:       url,
+		Secret:    "test-secret",
+	}
+}
+
+func TestDeliverySignature(t *testing.T) {
+	delivery := testDelivery("")
+
+	received := make(chan *http.Request, 1)
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer srv.Close()
+
+	delivery.URL = srv.URL
+	db := newMemStorage(delivery)
+	d := Dispatcher{DB: db, Client: srv.Client(), Retry: messaging.RetryPolicy{Attempts: 3}, BatchSize: 10}
+
+	d.flush(context.Background())
+
+	r := <-received
+	if got := r.Header.Get(HeaderEvent); got != delivery.EventType {
+		t.Errorf("%s = %q, want %q", HeaderEvent, got, delivery.EventType)
+	}
+	if got := r.Header.Get(HeaderID); got != delivery.EventID {
+		t.Errorf("%s = %q, want %q", HeaderID, got, delivery.EventID)
+	}
+	if string(body) != string(delivery.Payload) {
+		t.Errorf("body = %s, want %s", body, delivery.Payload)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("parse %s: %v", HeaderTimestamp, err)
+	}
+	want := Sign(delivery.Secret, timestamp, body)
+	if got := r.Header.Get(HeaderSignature); got != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, got, want)
+	}
+
+	// the signature covers "<timestamp>.<body>", a different timestamp doesn't match
+	if Sign(delivery.Secret, timestamp+1, body) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+
+	if got := db.delivery(delivery.ID); got.Status != models.WebhookDelivered || got.ResponseStatus != http.StatusOK {
+		t.Errorf("delivery = %s/%d, want %s/200", got.Status, got.ResponseStatus, models.WebhookDelivered)
+	}
+}
+
+func TestDeliveryRetriedThenFailed(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	delivery := testDelivery(srv.URL)
+	db := newMemStorage(delivery)
+	d := Dispatcher{
+		DB:     db,
+		Client: srv.Client(),
+		Retry: messaging.RetryPolicy{
+			Attempts:       4,
+			InitialBackoff: time.Second,
+			MaxBackoff:     3 * time.Second,
+		},
+		BatchSize: 10,
+	}
+
+	for i := 0; i < d.Retry.Attempts+2; i++ {
+		before := time.Now()
+		d.flush(context.Background())
+
+		// every failed attempt but the last one schedules the next after the backoff
+		next := db.next[delivery.ID]
+		if i < d.Retry.Attempts-1 {
+			if len(next) != i+1 {
+				t.Fatalf("attempt %d: %d retries scheduled, want %d", i+1, len(next), i+1)
+			}
+			wait := next[i].Sub(before)
+			want := d.backoff(i + 1)
+			if wait < want || wait > want+time.Second {
+				t.Errorf("attempt %d: retried after %s, want %s", i+1, wait, want)
+			}
+		}
+	}
+
+	wantBackoff := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i, want := range wantBackoff {
+		if got := d.backoff(i + 1); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, want)
+		}
+	}
+
+	got := db.delivery(delivery.ID)
+	if got.Status != models.WebhookFailed {
+		t.Errorf("status = %s, want %s", got.Status, models.WebhookFailed)
+	}
+	if got.Attempts != d.Retry.Attempts || hits != d.Retry.Attempts {
+		t.Errorf("attempts = %d, requests = %d, want %d", got.Attempts, hits, d.Retry.Attempts)
+	}
+	if got.ResponseStatus != http.StatusServiceUnavailable {
+		t.Errorf("response status = %d, want %d", got.ResponseStatus, http.StatusServiceUnavailable)
+	}
+}
+
+func TestClientRefusesInternalAddress(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+
+	d := Dispatcher{Client: NewClient(time.Second)}
+
+	_, err := d.deliver(context.Background(), testDelivery(srv.URL))
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("deliver to loopback: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+	if hit {
+		t.Error("request reached the loopback receiver")
+	}
+}
@@ -0,0 +1,32 @@
+// Package service runs order-service. It is importable from outside the service,
+// so tools/devstack can run it in one process with loyalty-service and sso-service.
+package service
+
+import (
+	"context"
+
+	"github.com/paranoiachains/loyalty-api/order-service/internal/app"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/outbox"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/process"
+	"github.com/paranoiachains/loyalty-api/order-service/internal/server"
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+)
+
+// Processor credits completed orders and applies their status updates
+type Processor = process.OrderProcessor
+
+// Relay publishes the order-created events of the outbox
+type Relay = outbox.Relay
+
+// Run serves the order api on flags.RunAddress until ctx is done
+func Run(ctx context.Context) error {
+	application, err := app.New(ctx)
+	if err != nil {
+		return err
+	}
+
+	go application.Processor.Process(ctx)
+
+	srv := server.New(application)
+	return srv.Run(ctx, flags.RunAddress)
+}
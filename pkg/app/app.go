@@ -2,18 +2,29 @@ package app
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	ssoauth "github.com/paranoiachains/loyalty-api/pkg/clients/sso/auth"
 	ssowithdraw "github.com/paranoiachains/loyalty-api/pkg/clients/sso/withdraw"
 	"github.com/paranoiachains/loyalty-api/pkg/database"
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/revocation"
+	"go.uber.org/zap"
 )
 
+var ErrNoVerificationKeys = errors.New("jwt keys file, secret or jwks url required to verify tokens")
+
 type App struct {
-	Kafka          *messaging.KafkaService
+	Kafka          messaging.Service
 	DB             database.Storage
 	Processor      MessageProcessor
-	StatusKafka    *messaging.KafkaService
+	StatusKafka    messaging.Service
 	AuthClient     *ssoauth.AuthClient
 	WithdrawClient *ssowithdraw.WithdrawalsClient
 }
@@ -21,3 +32,88 @@ type App struct {
 type MessageProcessor interface {
 	Process(ctx context.Context)
 }
+
+// MessagingConfig builds the service's messaging settings from flags.
+// defaultGroupID is used unless a consumer group is configured explicitly.
+func MessagingConfig(defaultGroupID string) messaging.Config {
+	groupID := flags.KafkaGroupID
+	if groupID == "" {
+		groupID = defaultGroupID
+	}
+
+	return messaging.Config{
+		Broker:       flags.Broker,
+		Brokers:      flags.KafkaBrokers,
+		GroupID:      groupID,
+		StartOffset:  messaging.StartOffset(flags.KafkaStartOffset),
+		BatchSize:    flags.KafkaBatchSize,
+		BatchTimeout: flags.KafkaBatchTimeout,
+		Topics: messaging.Topics{
+			OrderCreated:   flags.TopicOrderCreated,
+			OrderCompleted: flags.TopicOrderCompleted,
+			OrderStatus:    flags.TopicOrderStatus,
+			TokenRevoked:   flags.TopicTokenRevoked,
+		},
+		Encoding: flags.EventEncoding,
+	}
+}
+
+func RetryPolicy() messaging.RetryPolicy {
+	return messaging.RetryPolicy{
+		Attempts:       flags.RetryAttempts,
+		InitialBackoff: flags.RetryBackoff,
+		MaxBackoff:     flags.RetryMaxBackoff,
+	}
+}
+
+// JWTKeys loads the jwt key set file if one is configured. Without one the set holds
+// a single HS256 key built from the secret, or an EdDSA key generated on startup.
+func JWTKeys() (*jwtkeys.KeySet, error) {
+	switch {
+	case flags.JWTKeysFile != "":
+		return jwtkeys.Load(flags.JWTKeysFile, flags.JWTTokenTTL)
+	case flags.JWTSecret != "":
+		return jwtkeys.FromSecret(flags.JWTSecret, flags.JWTTokenTTL), nil
+	default:
+		logger.Log.Warn("no jwt keys file is set, signing with a generated key: issued tokens are invalid after a restart")
+		return jwtkeys.Generate(flags.JWTTokenTTL)
+	}
+}
+
+// TokenKeyfunc selects the key verifying a token. By default the service only holds the
+// public keys published by sso, with a keys file or a secret it verifies with the local key set.
+func TokenKeyfunc() (jwt.Keyfunc, error) {
+	if flags.JWTKeysFile != "" || flags.JWTSecret != "" {
+		keys, err := JWTKeys()
+		if err != nil {
+			return nil, err
+		}
+		return keys.Keyfunc, nil
+	}
+
+	if flags.JWKSURL == "" {
+		return nil, ErrNoVerificationKeys
+	}
+	fetch := jwtkeys.FetchHTTP(&http.Client{Timeout: 5 * time.Second}, flags.JWKSURL)
+	return jwtkeys.NewRemote(fetch, time.Hour, 30*time.Second).Keyfunc, nil
+}
+
+// RevocationList starts a local copy of the sso revocation list
+// which follows the token revoked events until ctx is done
+func RevocationList(ctx context.Context, client *ssoauth.AuthClient, cfg messaging.Config) *revocation.List {
+	events := messaging.NewTokenRevokedBroker(cfg)
+	events.Start(ctx)
+
+	// the memory broker only carries events when sso runs in the same process, otherwise
+	// revocations only arrive with the reload and revoked tokens stay usable for up to its interval
+	reload := time.Minute
+	if cfg.Broker == messaging.BrokerMemory {
+		reload = 5 * time.Second
+		logger.Log.Warn("memory broker: revocations are picked up by polling sso", zap.Duration("interval", reload))
+	}
+
+	list := revocation.NewList(client.RevokedTokens, reload)
+	go list.Run(ctx, events.Receive())
+
+	return list
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	sso_grpc "github.com/paranoiachains/loyalty-api/grpc-service/gen/go/sso"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -17,6 +19,12 @@ import (
 var (
 	ErrWrongPassword     = errors.New("wrong password")
 	ErrUserAlreadyExists = errors.New("such user already exists")
+	// the refresh token is unknown, expired, already used or its session is revoked
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrInvalidResetToken   = errors.New("invalid password reset token")
+	// sso has no way to deliver reset tokens
+	ErrPasswordResetDisabled = errors.New("password reset is disabled")
 )
 
 type AuthClient struct {
@@ -34,7 +42,8 @@ func New(address string) (*AuthClient, error) {
 	return &AuthClient{authClient: client}, nil
 }
 
-func (c *AuthClient) Login(ctx context.Context, login string, password string) (string, error) {
+// Login returns an access token and a refresh token
+func (c *AuthClient) Login(ctx context.Context, login string, password string) (string, string, error) {
 	resp, err := c.authClient.Login(ctx, &sso_grpc.LoginRequest{
 		Login:    login,
 		Password: password,
@@ -47,19 +56,20 @@ func (c *AuthClient) Login(ctx context.Context, login string, password string) (
 			switch st.Code() {
 			case codes.PermissionDenied:
 				logger.Log.Debug("login (permission denied error)")
-				return "", ErrWrongPassword
+				return "", "", ErrWrongPassword
 			default:
-				return "", fmt.Errorf("unexpected grpc error: %w", err)
+				return "", "", fmt.Errorf("unexpected grpc error: %w", err)
 			}
 		} else {
-			return "", err
+			return "", "", err
 		}
 	}
 
-	return resp.Token, nil
+	return resp.Token, resp.RefreshToken, nil
 }
 
-func (c *AuthClient) RegisterNewUser(ctx context.Context, login string, password string) (int64, string, error) {
+// RegisterNewUser returns the id of the new user, an access token and a refresh token
+func (c *AuthClient) RegisterNewUser(ctx context.Context, login string, password string) (int64, string, string, error) {
 	resp, err := c.authClient.Register(ctx, &sso_grpc.RegisterRequest{
 		Login:    login,
 		Password: password,
@@ -69,14 +79,145 @@ func (c *AuthClient) RegisterNewUser(ctx context.Context, login string, password
 		if ok {
 			switch st.Code() {
 			case codes.AlreadyExists:
-				return 0, "", ErrUserAlreadyExists
+				return 0, "", "", ErrUserAlreadyExists
 			default:
-				return 0, "", fmt.Errorf("unexpected grpc error: %w", err)
+				return 0, "", "", fmt.Errorf("unexpected grpc error: %w", err)
 			}
 		} else {
-			return 0, "", err
+			return 0, "", "", err
 		}
 	}
 
-	return resp.UserId, resp.Token, nil
+	return resp.UserId, resp.Token, resp.RefreshToken, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token,
+// the presented refresh token can't be used again
+func (c *AuthClient) Refresh(ctx context.Context, refreshToken string) (string, string, error) {
+	resp, err := c.authClient.Refresh(ctx, &sso_grpc.RefreshRequest{
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			switch st.Code() {
+			case codes.Unauthenticated, codes.InvalidArgument:
+				return "", "", ErrInvalidRefreshToken
+			default:
+				return "", "", fmt.Errorf("unexpected grpc error: %w", err)
+			}
+		} else {
+			return "", "", err
+		}
+	}
+
+	return resp.Token, resp.RefreshToken, nil
+}
+
+// Logout revokes the session of the access token
+func (c *AuthClient) Logout(ctx context.Context, token string) error {
+	_, err := c.authClient.Logout(ctx, &sso_grpc.LogoutRequest{Token: token})
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			switch st.Code() {
+			case codes.Unauthenticated, codes.InvalidArgument:
+				return ErrInvalidToken
+			default:
+				return fmt.Errorf("unexpected grpc error: %w", err)
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangePassword sets a new password of the token's user, the user's other sessions are revoked
+func (c *AuthClient) ChangePassword(ctx context.Context, token string, oldPassword string, newPassword string) error {
+	_, err := c.authClient.ChangePassword(ctx, &sso_grpc.ChangePasswordRequest{
+		Token:       token,
+		OldPassword: oldPassword,
+		NewPassword: newPassword,
+	})
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			switch st.Code() {
+			case codes.Unauthenticated:
+				return ErrInvalidToken
+			case codes.PermissionDenied:
+				return ErrWrongPassword
+			default:
+				return fmt.Errorf("unexpected grpc error: %w", err)
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RequestPasswordReset has a reset token sent to the user, unknown logins aren't reported
+func (c *AuthClient) RequestPasswordReset(ctx context.Context, login string) error {
+	_, err := c.authClient.RequestPasswordReset(ctx, &sso_grpc.RequestPasswordResetRequest{Login: login})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return ErrPasswordResetDisabled
+		}
+		return fmt.Errorf("unexpected grpc error: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token, every session of the user is revoked
+func (c *AuthClient) ResetPassword(ctx context.Context, resetToken string, newPassword string) error {
+	_, err := c.authClient.ResetPassword(ctx, &sso_grpc.ResetPasswordRequest{
+		ResetToken:  resetToken,
+		NewPassword: newPassword,
+	})
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			switch st.Code() {
+			case codes.Unauthenticated:
+				return ErrInvalidResetToken
+			case codes.Unimplemented:
+				return ErrPasswordResetDisabled
+			default:
+				return fmt.Errorf("unexpected grpc error: %w", err)
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokedTokens fetches the revocation list, it can be used as a revocation.FetchFunc
+func (c *AuthClient) RevokedTokens(ctx context.Context) ([]models.RevokedToken, error) {
+	resp, err := c.authClient.RevokedTokens(ctx, &sso_grpc.RevokedTokensRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("unexpected grpc error: %w", err)
+	}
+
+	revoked := make([]models.RevokedToken, 0, len(resp.Tokens))
+	for _, token := range resp.Tokens {
+		expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt)
+		if err != nil {
+			logger.Log.Error("parse expires_at", zap.Error(err))
+			return nil, err
+		}
+		revoked = append(revoked, models.RevokedToken{
+			JTI:       token.Jti,
+			SessionID: token.SessionId,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	return revoked, nil
 }
@@ -17,7 +17,8 @@ import (
 )
 
 var (
-	ErrNotEnough = errors.New("not enough points")
+	ErrNotEnough        = errors.New("not enough points")
+	ErrOrderAlreadyUsed = errors.New("order already used for a withdrawal")
 )
 
 type WithdrawalsClient struct {
@@ -35,21 +36,24 @@ func New(address string) (*WithdrawalsClient, error) {
 	return &WithdrawalsClient{withdrawalsClient: client}, nil
 }
 
-func (w *WithdrawalsClient) TopUp(ctx context.Context, userID int64, sum float64) error {
-	logger.Log.Info("grpc top up call", zap.Int64("user_id", userID), zap.Float64("sum", sum))
+// TopUp credits sum for the given accrual order. Applied is false if the
+// order had been credited before, so replaying the same order is harmless.
+func (w *WithdrawalsClient) TopUp(ctx context.Context, order int64, userID int64, sum float64) (applied bool, err error) {
+	logger.Log.Info("grpc top up call", zap.Int64("order", order), zap.Int64("user_id", userID), zap.Float64("sum", sum))
 
-	_, err := w.withdrawalsClient.TopUp(ctx, &sso_grpc.TopUpRequest{
+	resp, err := w.withdrawalsClient.TopUp(ctx, &sso_grpc.TopUpRequest{
+		Order:  order,
 		UserId: userID,
 		Sum:    sum,
 	})
 	if err != nil {
 		logger.Log.Error("grpc call top up", zap.Error(err))
-		return err
+		return false, err
 	}
 
-	logger.Log.Info("grpc top up call successful")
+	logger.Log.Info("grpc top up call successful", zap.Bool("applied", resp.Applied))
 
-	return nil
+	return resp.Applied, nil
 }
 
 func (w *WithdrawalsClient) Balance(ctx context.Context, userID int64) (current float64, withdrawn float64, err error) {
@@ -82,6 +86,8 @@ func (w *WithdrawalsClient) Withdraw(ctx context.Context, order int64, userID in
 			switch st.Code() {
 			case codes.Canceled:
 				return ErrNotEnough
+			case codes.AlreadyExists:
+				return ErrOrderAlreadyUsed
 			default:
 				return fmt.Errorf("unexpected grpc error: %w", err)
 			}
@@ -12,14 +12,28 @@ var (
 	ErrUniqueUsername = errors.New("username already exists")
 	ErrAlreadyExists  = errors.New("accrual for this order already exists for the same user")
 	ErrAnotherUser    = errors.New("accrual for this order was already uploaded by other user")
+	ErrOrderNotFound  = errors.New("order not found")
+	ErrNotOrderOwner  = errors.New("order belongs to another user")
 )
 
 type AccrualStorage interface {
+	// SetStatus moves an order along the status model (see ValidateTransition).
+	// Illegal transitions return a *TransitionError, unknown statuses ErrUnknownStatus.
 	SetStatus(ctx context.Context, accrualOrderID int, status string) error
+	// SetStatusWithAccrual is SetStatus which also stores the accrual of the order. The
+	// accrual is only written once the transition is validated, in the same transaction.
+	SetStatusWithAccrual(ctx context.Context, accrualOrderID int, status string, accrual float64) error
 	UpdateAccrual(ctx context.Context, accrualOrderID int, accrual float64) error
-	GetOrders(ctx context.Context, userID int) ([]models.Accrual, error)
+	// GetOrders returns a page of the user's orders and the cursor of the next page,
+	// which is nil on the last page
+	GetOrders(ctx context.Context, userID int, query OrdersQuery) ([]models.Accrual, *Cursor, error)
 	GetOrder(ctx context.Context, accrualOrderID int) (*models.Accrual, error)
 	CreateAccrual(ctx context.Context, accrualOrderID int, userID int) (*models.Accrual, error)
+	// CreateAccruals creates the accruals in one tx and returns a result per order:
+	// nil if it was created, ErrAlreadyExists or ErrAnotherUser if it had been uploaded before
+	CreateAccruals(ctx context.Context, accrualOrderIDs []int, userID int) ([]error, error)
+	// GetOrderHistory returns status changes of the user's order, oldest first
+	GetOrderHistory(ctx context.Context, accrualOrderID int, userID int) ([]models.StatusChange, error)
 }
 
 type UserStorage interface {
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor points at the last order of a page, orders are sorted by (uploaded_at, accrual_order_id)
+type Cursor struct {
+	UploadedAt time.Time
+	OrderID    int
+}
+
+// Encode returns an opaque string safe to pass in a query parameter
+func (c Cursor) Encode() string {
+	raw := strconv.FormatInt(c.UploadedAt.UnixMicro(), 10) + "|" + strconv.Itoa(c.OrderID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	micros, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	uploadedAt, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	orderID, err := strconv.Atoi(id)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	// timestamps are stored without a time zone and scanned back as UTC
+	return Cursor{UploadedAt: time.UnixMicro(uploadedAt).UTC(), OrderID: orderID}, nil
+}
+
+// OrdersQuery selects one page of a user's orders
+type OrdersQuery struct {
+	// only orders in one of these statuses, all of them if empty
+	Statuses []string
+	// uploaded_at range, From is inclusive and To exclusive. Zero means unbounded
+	From time.Time
+	To   time.Time
+	// orders after this one, the first page if nil
+	After *Cursor
+	Limit int
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+)
+
+var (
+	ErrUnknownStatus     = errors.New("unknown order status")
+	ErrIllegalTransition = errors.New("illegal order status transition")
+	// a transition to a status the order has already passed, e.g. a stale event
+	ErrStatusRegression = errors.New("order status can't move backwards")
+)
+
+// statuses an order may move to from each status:
+// NEW -> PROCESSING -> PROCESSED or INVALID.
+// REGISTERED is how the loyalty service names a NEW order.
+var transitions = map[string][]string{
+	models.StatusNew:        {models.StatusProcessing},
+	models.StatusRegistered: {models.StatusProcessing},
+	models.StatusProcessing: {models.StatusProcessed, models.StatusInvalid},
+	models.StatusProcessed:  nil,
+	models.StatusInvalid:    nil,
+}
+
+// position of a status in the lifecycle, used to tell regressions from other illegal transitions
+var stage = map[string]int{
+	models.StatusNew:        0,
+	models.StatusRegistered: 0,
+	models.StatusProcessing: 1,
+	models.StatusProcessed:  2,
+	models.StatusInvalid:    2,
+}
+
+// TransitionError is returned for a transition the status model doesn't allow.
+// It matches ErrIllegalTransition, and ErrStatusRegression when the order would move backwards.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order status can't change from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	switch target {
+	case ErrIllegalTransition:
+		return true
+	case ErrStatusRegression:
+		return stage[e.To] < stage[e.From]
+	}
+	return false
+}
+
+func ValidStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// IsFinal reports whether no transition leads out of status
+func IsFinal(status string) bool {
+	next, ok := transitions[status]
+	return ok && len(next) == 0
+}
+
+// ValidateTransition checks that an order may move from one status to another.
+// Staying in the same status is allowed, so that redelivered events are no-ops.
+func ValidateTransition(from, to string) error {
+	if !ValidStatus(to) {
+		return fmt.Errorf("%w: %q", ErrUnknownStatus, to)
+	}
+	if !ValidStatus(from) {
+		return fmt.Errorf("%w: %q", ErrUnknownStatus, from)
+	}
+	if from == to {
+		return nil
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to}
+}
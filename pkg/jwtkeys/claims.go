@@ -0,0 +1,12 @@
+package jwtkeys
+
+import "github.com/golang-jwt/jwt/v4"
+
+// Claims are the claims of access tokens issued by the sso service.
+// ID (jti) identifies the token and SessionID the login it was issued for,
+// either of them can be revoked before the token expires.
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID    int64  `json:"user_id"`
+	SessionID string `json:"sid,omitempty"`
+}
@@ -0,0 +1,234 @@
+package jwtkeys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set. HS256 keys are secret and never published,
+// so services verifying through the key set only accept RS256 and EdDSA tokens.
+func (s *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: make([]JWK, 0)}
+	for _, key := range s.Keys() {
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return set
+}
+
+// Key converts the JWK to a verify-only key
+func (k JWK) Key() (*Key, error) {
+	key := &Key{ID: k.Kid, Algorithm: k.Alg}
+
+	switch {
+	case k.Kty == "RSA" && k.Alg == AlgRS256:
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decode modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decode exponent: %w", err)
+		}
+		key.Public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && k.Alg == AlgEdDSA:
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("decode public key: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key size")
+		}
+		key.Public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("%w: kty %q, alg %q", ErrUnsupportedAlg, k.Kty, k.Alg)
+	}
+
+	return key, nil
+}
+
+// FetchFunc downloads the current key set
+type FetchFunc func(ctx context.Context) (JWKS, error)
+
+// FetchHTTP downloads the key set from a JWKS url, e.g. http://sso-service:5002/.well-known/jwks.json
+func FetchHTTP(client *http.Client, url string) FetchFunc {
+	return func(ctx context.Context) (JWKS, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return JWKS{}, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return JWKS{}, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return JWKS{}, fmt.Errorf("fetch jwks: unexpected response status %d", resp.StatusCode)
+		}
+
+		var set JWKS
+		if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+			return JWKS{}, fmt.Errorf("decode jwks: %w", err)
+		}
+		return set, nil
+	}
+}
+
+// Remote caches a published key set. The set is refreshed once it is older than
+// MaxAge and whenever a token names an unknown kid, but at most once per MinRefresh
+// so that tokens with made up kids can't flood the key server.
+type Remote struct {
+	fetch      FetchFunc
+	maxAge     time.Duration
+	minRefresh time.Duration
+	refreshes  singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]*Key
+	fetchedAt time.Time
+}
+
+func NewRemote(fetch FetchFunc, maxAge, minRefresh time.Duration) *Remote {
+	return &Remote{
+		fetch:      fetch,
+		maxAge:     maxAge,
+		minRefresh: minRefresh,
+		keys:       make(map[string]*Key),
+	}
+}
+
+// Keyfunc selects the verification key by the token's kid header
+func (r *Remote) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := r.key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	// the algorithm comes from the key, never from the token
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("%w: %s signed with %s", ErrAlgMismatch, kid, token.Method.Alg())
+	}
+
+	return key.VerificationKey(), nil
+}
+
+func (r *Remote) key(kid string) (*Key, error) {
+	r.mu.Lock()
+	key, ok := r.keys[kid]
+	stale := time.Since(r.fetchedAt) > r.maxAge
+	r.mu.Unlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	r.refresh()
+
+	r.mu.Lock()
+	key, ok = r.keys[kid]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set unless it was fetched within minRefresh. Concurrent
+// callers share a single fetch and mu is only held to swap the keys.
+func (r *Remote) refresh() {
+	r.refreshes.Do("jwks", func() (any, error) {
+		r.mu.Lock()
+		due := time.Since(r.fetchedAt) > min(r.minRefresh, r.maxAge)
+		if due {
+			// a failed attempt counts as a refresh too, it is retried after minRefresh
+			r.fetchedAt = time.Now()
+		}
+		r.mu.Unlock()
+
+		if !due {
+			return nil, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		set, err := r.fetch(ctx)
+		if err != nil {
+			// keep verifying with the cached keys while the key server is unavailable
+			logger.Log.Error("refresh jwks", zap.Error(err))
+			return nil, err
+		}
+
+		keys := make(map[string]*Key, len(set.Keys))
+		for _, jwk := range set.Keys {
+			key, err := jwk.Key()
+			if err != nil {
+				logger.Log.Warn("skip jwk", zap.String("kid", jwk.Kid), zap.Error(err))
+				continue
+			}
+			keys[key.ID] = key
+		}
+
+		r.mu.Lock()
+		r.keys = keys
+		r.mu.Unlock()
+
+		logger.Log.Info("jwks refreshed", zap.Int("keys", len(keys)))
+		return nil, nil
+	})
+}
@@ -0,0 +1,299 @@
+// Package jwtkeys loads the keys tokens are signed and verified with.
+//
+// A key set file lists every key by its kid. The active key signs new tokens,
+// retired keys only verify the tokens they signed until those expire:
+//
+//	{
+//	  "active": "2025-06",
+//	  "keys": [
+//	    {"kid": "2025-06", "alg": "EdDSA", "private_key_file": "/etc/sso/ed25519.pem"},
+//	    {"kid": "2025-01", "alg": "RS256", "public_key_file": "/etc/sso/rsa.pub.pem", "retired_at": "2025-06-01T00:00:00Z"},
+//	    {"kid": "legacy", "alg": "HS256", "secret": "...", "retired_at": "2025-01-01T00:00:00Z"}
+//	  ]
+//	}
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// kid of the key built from a plain secret
+const DefaultKeyID = "default"
+
+var (
+	ErrUnknownKey       = errors.New("unknown signing key")
+	ErrKeyExpired       = errors.New("signing key is retired and its tokens have expired")
+	ErrAlgMismatch      = errors.New("token algorithm doesn't match its key")
+	ErrNoActiveKey      = errors.New("key set has no active key")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrNoPrivateKey     = errors.New("key can only verify tokens")
+	ErrMissingKeyConfig = errors.New("key needs a secret, a private or a public key")
+)
+
+type Key struct {
+	ID        string
+	Algorithm string
+	// HS256 secret
+	Secret []byte
+	// RS256 or EdDSA keys, Private is nil for verify-only keys
+	Private crypto.Signer
+	Public  crypto.PublicKey
+	// zero for keys that are still in use
+	RetiredAt time.Time
+}
+
+// Method returns the jwt signing method of the key
+func (k *Key) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// SigningKey is what the jwt library signs with
+func (k *Key) SigningKey() (any, error) {
+	if k.Algorithm == AlgHS256 {
+		return k.Secret, nil
+	}
+	if k.Private == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPrivateKey, k.ID)
+	}
+	return k.Private, nil
+}
+
+// VerificationKey is what the jwt library verifies with
+func (k *Key) VerificationKey() any {
+	if k.Algorithm == AlgHS256 {
+		return k.Secret
+	}
+	return k.Public
+}
+
+// KeySet holds the active key and the keys still accepted for verification
+type KeySet struct {
+	keys   map[string]*Key
+	active string
+	// lifetime of issued tokens, retired keys are kept this long
+	tokenTTL time.Duration
+}
+
+func NewKeySet(active string, tokenTTL time.Duration, keys ...*Key) (*KeySet, error) {
+	set := &KeySet{keys: make(map[string]*Key, len(keys)), active: active, tokenTTL: tokenTTL}
+	for _, key := range keys {
+		if !supported(key.Algorithm) {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, key.Algorithm)
+		}
+		set.keys[key.ID] = key
+	}
+
+	if active != "" {
+		key, ok := set.keys[active]
+		if !ok {
+			return nil, fmt.Errorf("%w: active key %q", ErrUnknownKey, active)
+		}
+		if !key.RetiredAt.IsZero() {
+			return nil, fmt.Errorf("active key %q is retired", active)
+		}
+	}
+
+	return set, nil
+}
+
+// FromSecret builds a set with a single HS256 key
+func FromSecret(secret string, tokenTTL time.Duration) *KeySet {
+	set, _ := NewKeySet(DefaultKeyID, tokenTTL, &Key{
+		ID:        DefaultKeyID,
+		Algorithm: AlgHS256,
+		Secret:    []byte(secret),
+	})
+	return set
+}
+
+// Generate builds a set with a single EdDSA key which only lives as long as the process,
+// tokens it signed can't be verified after a restart
+func Generate(tokenTTL time.Duration) (*KeySet, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := "ephemeral-" + hex.EncodeToString(public[:8])
+	return NewKeySet(kid, tokenTTL, &Key{
+		ID:        kid,
+		Algorithm: AlgEdDSA,
+		Private:   private,
+		Public:    public,
+	})
+}
+
+type fileKey struct {
+	ID             string    `json:"kid"`
+	Algorithm      string    `json:"alg"`
+	Secret         string    `json:"secret"`
+	PrivateKeyFile string    `json:"private_key_file"`
+	PublicKeyFile  string    `json:"public_key_file"`
+	RetiredAt      time.Time `json:"retired_at"`
+}
+
+type file struct {
+	Active string    `json:"active"`
+	Keys   []fileKey `json:"keys"`
+}
+
+// Load reads a key set file, see the package doc for its format.
+// Relative key file paths are resolved from the working directory.
+func Load(path string, tokenTTL time.Duration) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse key set %s: %w", path, err)
+	}
+
+	keys := make([]*Key, 0, len(f.Keys))
+	for _, fk := range f.Keys {
+		key, err := loadKey(fk)
+		if err != nil {
+			return nil, fmt.Errorf("load key %q: %w", fk.ID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeySet(f.Active, tokenTTL, keys...)
+}
+
+func loadKey(fk fileKey) (*Key, error) {
+	key := &Key{ID: fk.ID, Algorithm: fk.Algorithm, RetiredAt: fk.RetiredAt}
+
+	switch fk.Algorithm {
+	case AlgHS256:
+		if fk.Secret == "" {
+			return nil, ErrMissingKeyConfig
+		}
+		key.Secret = []byte(fk.Secret)
+		return key, nil
+	case AlgRS256, AlgEdDSA:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, fk.Algorithm)
+	}
+
+	if fk.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(fk.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var private crypto.PrivateKey
+		if fk.Algorithm == AlgRS256 {
+			private, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+		} else {
+			private, err = jwt.ParseEdPrivateKeyFromPEM(pem)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: private key can't sign", ErrUnsupportedAlg)
+		}
+		key.Private = signer
+		key.Public = signer.Public()
+		return key, nil
+	}
+
+	if fk.PublicKeyFile != "" {
+		pem, err := os.ReadFile(fk.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if fk.Algorithm == AlgRS256 {
+			key.Public, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		} else {
+			key.Public, err = jwt.ParseEdPublicKeyFromPEM(pem)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	return nil, ErrMissingKeyConfig
+}
+
+func supported(alg string) bool {
+	return alg == AlgHS256 || alg == AlgRS256 || alg == AlgEdDSA
+}
+
+// Active returns the key new tokens are signed with
+func (s *KeySet) Active() (*Key, error) {
+	key, ok := s.keys[s.active]
+	if !ok {
+		return nil, ErrNoActiveKey
+	}
+	return key, nil
+}
+
+// Key returns the key with the given kid, as long as tokens signed with it may still be valid
+func (s *KeySet) Key(kid string) (*Key, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	if !key.RetiredAt.IsZero() && time.Now().After(key.RetiredAt.Add(s.tokenTTL)) {
+		return nil, fmt.Errorf("%w: %q", ErrKeyExpired, kid)
+	}
+	return key, nil
+}
+
+// Keys returns every key still accepted for verification, sorted by kid
+func (s *KeySet) Keys() []*Key {
+	keys := make([]*Key, 0, len(s.keys))
+	for kid := range s.keys {
+		if key, err := s.Key(kid); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Keyfunc selects the verification key by the token's kid header. Tokens without
+// a kid were issued before key rotation and are checked with the default key.
+func (s *KeySet) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = DefaultKeyID
+	}
+
+	key, err := s.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	// the algorithm comes from the key, never from the token
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("%w: %s signed with %s", ErrAlgMismatch, kid, token.Method.Alg())
+	}
+
+	return key.VerificationKey(), nil
+}
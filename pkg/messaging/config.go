@@ -0,0 +1,54 @@
+package messaging
+
+import (
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Topics maps the logical topics to the kafka topics a deployment uses,
+// so several environments can share one cluster
+type Topics struct {
+	OrderCreated   string
+	OrderCompleted string
+	OrderStatus    string
+	TokenRevoked   string
+}
+
+var DefaultTopics = Topics{
+	OrderCreated:   TopicOrderCreated,
+	OrderCompleted: TopicOrderCompleted,
+	OrderStatus:    TopicOrderStatus,
+	TokenRevoked:   TopicTokenRevoked,
+}
+
+// Config holds the messaging settings of a single service
+type Config struct {
+	// kafka or memory
+	Broker  string
+	Brokers []string
+	// every service consumes with its own group, so each one gets all messages
+	GroupID string
+	// where a new consumer group starts reading: kafka.FirstOffset or kafka.LastOffset
+	StartOffset  int64
+	BatchSize    int
+	BatchTimeout time.Duration
+	Topics       Topics
+	// json or protobuf, how this service encodes the events it produces
+	Encoding string
+}
+
+func (c Config) ContentType() string {
+	if c.Encoding == EncodingProtobuf {
+		return ContentTypeProtobuf
+	}
+	return ContentTypeJSON
+}
+
+// StartOffset converts "first" or "last" to a kafka start offset
+func StartOffset(offset string) int64 {
+	if offset == "first" {
+		return kafka.FirstOffset
+	}
+	return kafka.LastOffset
+}
@@ -0,0 +1,197 @@
+package messaging
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// event types carried by the envelope
+const (
+	EventOrderCreated   = "order.created"
+	EventOrderCompleted = "order.completed"
+	EventOrderStatus    = "order.status_updated"
+	// only sent to webhooks, services don't consume it
+	EventBalanceToppedUp = "balance.topped_up"
+	// a session was logged out, every service verifying tokens consumes it
+	EventTokenRevoked = "token.revoked"
+)
+
+// producers stamped on the envelope
+const (
+	ProducerOrderService   = "order-service"
+	ProducerLoyaltyService = "loyalty-service"
+	ProducerSSOService     = "sso-service"
+)
+
+var (
+	ErrUnexpectedEventType = errors.New("unexpected event type")
+	ErrUnsupportedVersion  = errors.New("unsupported event schema version")
+)
+
+// Envelope wraps every event published between services
+type Envelope struct {
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Producer      string          `json:"producer"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// Upcaster converts a payload from one schema version to the next one
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+var (
+	schemaMu sync.RWMutex
+	// the version producers write and consumers expect
+	schemaVersions = map[string]int{
+		EventOrderCreated:    1,
+		EventOrderCompleted:  1,
+		EventOrderStatus:     1,
+		EventBalanceToppedUp: 1,
+		EventTokenRevoked:    1,
+	}
+	// upcasters[eventType][v] converts version v to v+1
+	upcasters = map[string]map[int]Upcaster{}
+)
+
+// version 0 is a bare payload sent before the envelope was introduced,
+// it is identical to version 1 of the payload
+func init() {
+	for eventType := range schemaVersions {
+		RegisterUpcaster(eventType, 0, func(payload json.RawMessage) (json.RawMessage, error) {
+			return payload, nil
+		})
+	}
+}
+
+// SetSchemaVersion changes the version of eventType this service produces and consumes
+func SetSchemaVersion(eventType string, version int) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	schemaVersions[eventType] = version
+}
+
+// RegisterUpcaster registers a conversion of eventType payloads from fromVersion to fromVersion+1
+func RegisterUpcaster(eventType string, fromVersion int, up Upcaster) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	if upcasters[eventType] == nil {
+		upcasters[eventType] = make(map[int]Upcaster)
+	}
+	upcasters[eventType][fromVersion] = up
+}
+
+func schemaVersion(eventType string) (int, bool) {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+
+	version, ok := schemaVersions[eventType]
+	return version, ok
+}
+
+func upcaster(eventType string, fromVersion int) (Upcaster, bool) {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+
+	up, ok := upcasters[eventType][fromVersion]
+	return up, ok
+}
+
+func NewEnvelope(eventType string, producer string, payload any) (Envelope, error) {
+	version, ok := schemaVersion(eventType)
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrUnexpectedEventType, eventType)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		EventID:       newEventID(),
+		EventType:     eventType,
+		SchemaVersion: version,
+		OccurredAt:    time.Now().UTC(),
+		Producer:      producer,
+		Payload:       data,
+	}, nil
+}
+
+// Marshal wraps payload into a new envelope and encodes it
+func Marshal(eventType string, producer string, payload any) ([]byte, error) {
+	env, err := NewEnvelope(eventType, producer, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Unmarshal decodes an event of the expected type into payload. Older schema
+// versions are upcast, newer ones are rejected with ErrUnsupportedVersion.
+// Messages without an envelope are treated as version 0.
+func Unmarshal(data []byte, eventType string, payload any) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, err
+	}
+
+	if env.EventType == "" {
+		env = Envelope{
+			EventType:     eventType,
+			SchemaVersion: 0,
+			Payload:       data,
+		}
+	}
+
+	if env.EventType != eventType {
+		return env, fmt.Errorf("%w: got %s, want %s", ErrUnexpectedEventType, env.EventType, eventType)
+	}
+
+	current, ok := schemaVersion(eventType)
+	if !ok {
+		return env, fmt.Errorf("%w: %s", ErrUnexpectedEventType, eventType)
+	}
+	if env.SchemaVersion > current {
+		return env, fmt.Errorf("%w: %s v%d, newest known is v%d",
+			ErrUnsupportedVersion, eventType, env.SchemaVersion, current)
+	}
+
+	for env.SchemaVersion < current {
+		up, ok := upcaster(eventType, env.SchemaVersion)
+		if !ok {
+			return env, fmt.Errorf("%w: no upcaster for %s v%d",
+				ErrUnsupportedVersion, eventType, env.SchemaVersion)
+		}
+
+		upcast, err := up(env.Payload)
+		if err != nil {
+			return env, fmt.Errorf("upcast %s v%d: %w", eventType, env.SchemaVersion, err)
+		}
+		env.Payload = upcast
+		env.SchemaVersion++
+	}
+
+	if err := json.Unmarshal(env.Payload, payload); err != nil {
+		return env, err
+	}
+
+	return env, nil
+}
+
+// newEventID returns a random (version 4) UUID
+func newEventID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
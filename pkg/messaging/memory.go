@@ -0,0 +1,137 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// MemoryHub is an in-process message bus. Every subscriber of a topic gets
+// its own buffered channel and receives every message published to it.
+// Delivery isn't durable, so Ack and Nack of its messages are no-ops.
+//
+// Messages never leave the process, so services only exchange events through it
+// when they run in one process: tools/devstack runs order-service, loyalty-service
+// and sso-service that way. Otherwise it's meant for tests and for running a single
+// service in isolation.
+type MemoryHub struct {
+	mu          sync.Mutex
+	bufferSize  int
+	subscribers map[string][]chan Message
+	// messages published before a topic had any subscriber, at most maxPending per topic
+	pending map[string][]Message
+}
+
+// topics nobody in the process subscribes to would otherwise grow forever
+const maxPending = 1000
+
+// shared by all memory services of the process, so services started
+// in one process exchange messages like they would through kafka
+var defaultHub = NewMemoryHub(100)
+
+func NewMemoryHub(bufferSize int) *MemoryHub {
+	return &MemoryHub{
+		bufferSize:  bufferSize,
+		subscribers: make(map[string][]chan Message),
+		pending:     make(map[string][]Message),
+	}
+}
+
+// PublishBatch publishes the records one by one, in order
+func (h *MemoryHub) PublishBatch(ctx context.Context, topic string, records []Record) error {
+	for _, record := range records {
+		if err := h.Publish(ctx, topic, record.Key, record.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publish fans msg out to all subscribers of the topic. It blocks while
+// a subscriber's buffer is full, the same way KafkaService.Send does.
+// A topic is a single ordered channel, so every key keeps its order.
+func (h *MemoryHub) Publish(ctx context.Context, topic string, key string, msg []byte) error {
+	m := Message{Key: key, Value: msg}
+
+	h.mu.Lock()
+	subscribers := h.subscribers[topic]
+	if len(subscribers) == 0 {
+		if len(h.pending[topic]) >= maxPending {
+			h.mu.Unlock()
+			logger.Log.Warn("no subscribers and the backlog is full, message dropped", zap.String("topic", topic))
+			return nil
+		}
+		h.pending[topic] = append(h.pending[topic], m)
+		h.mu.Unlock()
+		logger.Log.Debug("no subscribers yet, message kept", zap.String("topic", topic))
+		return nil
+	}
+	h.mu.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a new consumer of the topic. The first subscriber
+// also receives messages published before it subscribed.
+func (h *MemoryHub) Subscribe(topic string) <-chan Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pending := h.pending[topic]
+	delete(h.pending, topic)
+
+	// the buffer fits the backlog, so it is delivered in order without blocking
+	ch := make(chan Message, max(h.bufferSize, len(pending)))
+	for _, msg := range pending {
+		ch <- msg
+	}
+	h.subscribers[topic] = append(h.subscribers[topic], ch)
+
+	return ch
+}
+
+// MemoryService implements MessageBroker on top of a MemoryHub,
+// reading from one topic and writing to another like KafkaService.
+type MemoryService struct {
+	hub          *MemoryHub
+	produceTopic string
+	consumeCh    <-chan Message
+}
+
+// NewMemoryService subscribes right away, so nothing published before Start is lost.
+// Empty topic disables the corresponding direction.
+func NewMemoryService(hub *MemoryHub, consumeTopic string, produceTopic string) *MemoryService {
+	m := &MemoryService{
+		hub:          hub,
+		produceTopic: produceTopic,
+	}
+	if consumeTopic != "" {
+		m.consumeCh = hub.Subscribe(consumeTopic)
+	}
+	return m
+}
+
+func (m *MemoryService) Start(ctx context.Context) {
+	logger.Log.Info("in-memory broker started!", zap.String("produce_topic", m.produceTopic))
+}
+
+func (m *MemoryService) Send(key string, msg []byte) {
+	if m.produceTopic == "" {
+		logger.Log.Error("send message: no topic to produce to")
+		return
+	}
+	m.hub.Publish(context.Background(), m.produceTopic, key, msg)
+}
+
+func (m *MemoryService) Receive() <-chan Message {
+	return m.consumeCh
+}
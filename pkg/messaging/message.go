@@ -0,0 +1,146 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// Message is a delivered message. The consumer calls Ack once the message has been
+// handled (or dead-lettered) and Nack if it gave up on it, e.g. during shutdown.
+type Message struct {
+	Key   string
+	Value []byte
+	ack   func()
+	nack  func()
+}
+
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+func (m Message) Nack() {
+	if m.nack != nil {
+		m.nack()
+	}
+}
+
+// offsetTracker commits kafka offsets only up to the last message which was
+// acknowledged together with everything fetched before it from the same partition.
+// Acks may arrive out of order when messages are handled concurrently.
+// A nacked message stops the tracker, the consumer then restarts from the
+// last committed offset, so the message and everything after it is redelivered.
+type offsetTracker struct {
+	reader *kafka.Reader
+	// readers without a consumer group have no offsets to commit
+	commit bool
+	stop   context.CancelFunc
+
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+	nacked     bool
+}
+
+type partitionOffsets struct {
+	// held while the offsets are advanced and committed, so commits of a partition stay in order
+	mu sync.Mutex
+	// fetched but not committed yet, in fetch order
+	pending []kafka.Message
+	acked   map[int64]bool
+}
+
+func newOffsetTracker(reader *kafka.Reader, stop context.CancelFunc) *offsetTracker {
+	return &offsetTracker{
+		reader:     reader,
+		commit:     reader.Config().GroupID != "",
+		stop:       stop,
+		partitions: make(map[int]*partitionOffsets),
+	}
+}
+
+// track registers a fetched message and wraps it into an acknowledgeable Message
+func (t *offsetTracker) track(m kafka.Message) Message {
+	p := t.partition(m.Partition)
+	p.mu.Lock()
+	p.pending = append(p.pending, m)
+	p.mu.Unlock()
+
+	return Message{
+		Key:   string(m.Key),
+		Value: m.Value,
+		ack:   func() { t.ack(m) },
+		nack:  func() { t.nack(m) },
+	}
+}
+
+func (t *offsetTracker) partition(partition int) *partitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partition]
+	if !ok {
+		p = &partitionOffsets{acked: make(map[int64]bool)}
+		t.partitions[partition] = p
+	}
+	return p
+}
+
+// Nacked reports whether the consumer has to be restarted
+func (t *offsetTracker) Nacked() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nacked
+}
+
+func (t *offsetTracker) nack(m kafka.Message) {
+	logger.Log.Warn("message nacked, consumer restarts to redeliver it",
+		zap.Int("partition", m.Partition),
+		zap.Int64("offset", m.Offset))
+
+	t.mu.Lock()
+	t.nacked = true
+	t.mu.Unlock()
+
+	// the offset stays uncommitted, nothing after it on the partition commits either
+	t.stop()
+}
+
+func (t *offsetTracker) ack(m kafka.Message) {
+	p := t.partition(m.Partition)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.acked[m.Offset] = true
+
+	var (
+		commit    kafka.Message
+		committed bool
+	)
+	for len(p.pending) > 0 && p.acked[p.pending[0].Offset] {
+		commit = p.pending[0]
+		committed = true
+		delete(p.acked, commit.Offset)
+		p.pending = p.pending[1:]
+	}
+
+	if !committed || !t.commit || t.Nacked() {
+		return
+	}
+
+	if err := t.reader.CommitMessages(context.Background(), commit); err != nil {
+		logger.Log.Error("commit offset",
+			zap.Int("partition", commit.Partition),
+			zap.Int64("offset", commit.Offset),
+			zap.Error(err))
+		return
+	}
+	logger.Log.Debug("offset committed",
+		zap.Int("partition", commit.Partition),
+		zap.Int64("offset", commit.Offset))
+}
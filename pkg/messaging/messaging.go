@@ -2,33 +2,83 @@ package messaging
 
 import (
 	"context"
+	"time"
 
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 )
 
+// broker implementations selectable through configuration
+const (
+	BrokerKafka  = "kafka"
+	BrokerMemory = "memory"
+)
+
+// logical topics, also used as the default kafka topic names
+const (
+	TopicOrderCreated   = "order-created"
+	TopicOrderCompleted = "order-completed"
+	TopicOrderStatus    = "order-status"
+	TopicTokenRevoked   = "token-revoked"
+)
+
 type KafkaService struct {
 	reader    *kafka.Reader
 	writer    *kafka.Writer
-	consumeCh chan []byte
-	produceCh chan []byte
+	consumeCh chan Message
+	produceCh chan kafka.Message
+	// content type of produced messages, consumed ones are decoded by their header
+	contentType string
 }
 
+// MessageBroker sends and receives messages. Messages with the same key
+// (the order number) keep their order, since they land on the same partition.
 type MessageBroker interface {
-	Send(msg []byte)
-	Receive() <-chan []byte
+	Send(key string, msg []byte)
+	Receive() <-chan Message
+}
+
+// Publisher synchronously writes a message to an arbitrary topic
+type Publisher interface {
+	Publish(ctx context.Context, topic string, key string, msg []byte) error
+}
+
+// Record is a keyed message of a batch
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// BatchPublisher synchronously writes several messages to a topic in one request,
+// records with the same key keep their order
+type BatchPublisher interface {
+	Publisher
+	PublishBatch(ctx context.Context, topic string, records []Record) error
+}
+
+// Service is a MessageBroker which has to be started before use
+type Service interface {
+	MessageBroker
+	Start(ctx context.Context)
 }
 
 func NewKafkaService(reader *kafka.Reader, writer *kafka.Writer) *KafkaService {
 	return &KafkaService{
-		reader:    reader,
-		writer:    writer,
-		consumeCh: make(chan []byte, 10),
-		produceCh: make(chan []byte, 10),
+		reader:      reader,
+		writer:      writer,
+		consumeCh:   make(chan Message, 10),
+		produceCh:   make(chan kafka.Message, 10),
+		contentType: ContentTypeJSON,
 	}
 }
 
+// WithContentType sets the encoding of produced messages
+func (k *KafkaService) WithContentType(contentType string) *KafkaService {
+	k.contentType = contentType
+	return k
+}
+
 func (k *KafkaService) Start(ctx context.Context) {
 	if k.reader != nil && k.consumeCh != nil {
 		go k.consumer(ctx)
@@ -38,11 +88,11 @@ func (k *KafkaService) Start(ctx context.Context) {
 	}
 }
 
-func (k *KafkaService) Send(msg []byte) {
-	k.produceCh <- msg
+func (k *KafkaService) Send(key string, msg []byte) {
+	k.produceCh <- kafka.Message{Key: []byte(key), Value: msg}
 }
 
-func (k *KafkaService) Receive() <-chan []byte {
+func (k *KafkaService) Receive() <-chan Message {
 	return k.consumeCh
 }
 
@@ -51,12 +101,15 @@ func (k *KafkaService) producer(ctx context.Context) {
 	for {
 		logger.Log.Info("waiting for msg...")
 		msg := <-k.produceCh
-		logger.Log.Info("kafka", zap.ByteString("got message from messages channel, sending to kafka", msg))
+		logger.Log.Info("kafka", zap.ByteString("got message from messages channel, sending to kafka", msg.Value))
 
+		value, contentType := encode(k.contentType, msg.Value)
 		err := k.writer.WriteMessages(
 			ctx,
 			kafka.Message{
-				Value: msg,
+				Key:     msg.Key,
+				Value:   value,
+				Headers: []kafka.Header{{Key: contentTypeHeader, Value: []byte(contentType)}},
 			},
 		)
 		if err != nil {
@@ -66,64 +119,284 @@ func (k *KafkaService) producer(ctx context.Context) {
 	}
 }
 
+// consumer fetches messages without committing them,
+// offsets are committed once the processor acknowledges the message
 func (k *KafkaService) consumer(ctx context.Context) {
 	logger.Log.Info("consumer started!")
+
+	cfg := k.reader.Config()
+	reader := k.reader
+	for {
+		nacked := k.consume(ctx, reader)
+		if err := reader.Close(); err != nil {
+			logger.Log.Error("close reader", zap.Error(err))
+		}
+		if !nacked || ctx.Err() != nil {
+			return
+		}
+
+		// a new reader resumes from the last committed offset of the group
+		logger.Log.Warn("restarting consumer after a nack")
+		reader = kafka.NewReader(cfg)
+	}
+}
+
+// consume hands fetched messages to the processor until fetching fails or
+// a message is nacked, it reports whether the consumer has to be restarted
+func (k *KafkaService) consume(ctx context.Context, reader *kafka.Reader) bool {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tracker := newOffsetTracker(reader, cancel)
 	for {
-		m, err := k.reader.ReadMessage(ctx)
+		m, err := reader.FetchMessage(fetchCtx)
 		if err != nil {
-			logger.Log.Error("read message", zap.Error(err))
-			break
+			if tracker.Nacked() {
+				return true
+			}
+			logger.Log.Error("fetch message", zap.Error(err))
+			return false
 		}
 		logger.Log.Info("got message from kafka", zap.ByteString("message", m.Value))
-		k.consumeCh <- m.Value
+
+		msg := tracker.track(m)
+		if contentType(m.Headers) == ContentTypeProtobuf {
+			msg.Value, err = decodeProtobuf(m.Value)
+			if err != nil {
+				// the raw payload is handed over, the processor dead-letters what it can't parse
+				logger.Log.Error("decode protobuf message", zap.Error(err))
+				msg.Value = m.Value
+			}
+		}
+
+		select {
+		case k.consumeCh <- msg:
+		case <-fetchCtx.Done():
+			return tracker.Nacked()
+		}
+	}
+}
+
+// encode converts a JSON event to the configured content type. Events which have
+// no protobuf schema are sent as JSON, the header tells the consumer which one it got.
+func encode(contentType string, msg []byte) ([]byte, string) {
+	if contentType != ContentTypeProtobuf {
+		return msg, ContentTypeJSON
+	}
+
+	value, err := encodeProtobuf(msg)
+	if err != nil {
+		logger.Log.Warn("encode protobuf message, falling back to json", zap.Error(err))
+		return msg, ContentTypeJSON
 	}
-	if err := k.reader.Close(); err != nil {
-		logger.Log.Error("close reader", zap.Error(err))
+	return value, ContentTypeProtobuf
+}
+
+// KafkaPublisher writes to any topic, the topic is set per message
+type KafkaPublisher struct {
+	writer      *kafka.Writer
+	contentType string
+}
+
+func NewKafkaPublisher(cfg Config) *KafkaPublisher {
+	writer := CreateWriter(cfg, "")
+	// every write waits for its ack, so nothing else would join a batch while it waits
+	writer.BatchTimeout = time.Millisecond
+	return &KafkaPublisher{writer: writer, contentType: ContentTypeJSON}
+}
+
+// WithContentType sets the encoding of published events
+func (p *KafkaPublisher) WithContentType(contentType string) *KafkaPublisher {
+	p.contentType = contentType
+	return p
+}
+
+// Publish returns once kafka acknowledged the message
+func (p *KafkaPublisher) Publish(ctx context.Context, topic string, key string, msg []byte) error {
+	return p.PublishBatch(ctx, topic, []Record{{Key: key, Value: msg}})
+}
+
+// PublishBatch returns once kafka acknowledged every record
+func (p *KafkaPublisher) PublishBatch(ctx context.Context, topic string, records []Record) error {
+	messages := make([]kafka.Message, 0, len(records))
+	for _, record := range records {
+		value, contentType := encode(p.contentType, record.Value)
+		messages = append(messages, kafka.Message{
+			Topic:   topic,
+			Key:     []byte(record.Key),
+			Value:   value,
+			Headers: []kafka.Header{{Key: contentTypeHeader, Value: []byte(contentType)}},
+		})
 	}
+	return p.writer.WriteMessages(ctx, messages...)
 }
 
-func CreateWriter(broker string, topic string) *kafka.Writer {
+func CreateWriter(cfg Config, topic string) *kafka.Writer {
 	return &kafka.Writer{
-		Addr:                   kafka.TCP(broker),
+		Addr:                   kafka.TCP(cfg.Brokers...),
 		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		BatchSize:              cfg.BatchSize,
+		BatchTimeout:           cfg.BatchTimeout,
 		AllowAutoTopicCreation: true,
 	}
 }
 
-func CreateReader(broker string, topic string) *kafka.Reader {
+func CreateReader(cfg Config, topic string) *kafka.Reader {
 	return kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{broker},
+		Brokers:     cfg.Brokers,
 		Topic:       topic,
 		MaxBytes:    10e6,
-		StartOffset: kafka.LastOffset,
-		GroupID:     "order",
+		StartOffset: cfg.StartOffset,
+		GroupID:     cfg.GroupID,
 	})
 }
 
-func InitOrderKafka() *KafkaService {
+func InitOrderKafka(cfg Config) *KafkaService {
 	return NewKafkaService(
-		CreateReader("kafka:9092", "order-completed"),
-		CreateWriter("kafka:9092", "order-created"),
-	)
+		CreateReader(cfg, cfg.Topics.OrderCompleted),
+		CreateWriter(cfg, cfg.Topics.OrderCreated),
+	).WithContentType(cfg.ContentType())
 }
 
-func InitLoyaltyKafka() *KafkaService {
+func InitLoyaltyKafka(cfg Config) *KafkaService {
 	return NewKafkaService(
-		CreateReader("kafka:9092", "order-created"),
-		CreateWriter("kafka:9092", "order-completed"),
-	)
+		CreateReader(cfg, cfg.Topics.OrderCreated),
+		CreateWriter(cfg, cfg.Topics.OrderCompleted),
+	).WithContentType(cfg.ContentType())
 }
 
-func InitStatusOrder() *KafkaService {
+func InitStatusOrder(cfg Config) *KafkaService {
 	return &KafkaService{
-		reader:    CreateReader("kafka:9092", "order-status"),
-		consumeCh: make(chan []byte, 10),
+		reader:    CreateReader(cfg, cfg.Topics.OrderStatus),
+		consumeCh: make(chan Message, 10),
 	}
 }
 
-func InitStatusLoyalty() *KafkaService {
+func InitStatusLoyalty(cfg Config) *KafkaService {
 	return &KafkaService{
-		writer:    CreateWriter("kafka:9092", "order-status"),
-		produceCh: make(chan []byte, 10),
+		writer:      CreateWriter(cfg, cfg.Topics.OrderStatus),
+		produceCh:   make(chan kafka.Message, 10),
+		contentType: cfg.ContentType(),
+	}
+}
+
+// TokenRevokedService reads every partition of the revocation topic without a consumer
+// group, so every instance of a service receives all revocations and no group is left
+// behind when it exits. Reading starts at the end of the topic, older revocations are
+// fetched from the sso service on start.
+type TokenRevokedService struct {
+	brokers   []string
+	topic     string
+	consumeCh chan Message
+}
+
+func InitTokenRevoked(cfg Config) *TokenRevokedService {
+	return &TokenRevokedService{
+		brokers:   cfg.Brokers,
+		topic:     cfg.Topics.TokenRevoked,
+		consumeCh: make(chan Message, 10),
+	}
+}
+
+func (s *TokenRevokedService) Start(ctx context.Context) {
+	for _, partition := range s.partitions(ctx) {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   s.brokers,
+			Topic:     s.topic,
+			Partition: partition,
+			MaxBytes:  10e6,
+		})
+		// without a group the start offset isn't applied, it is set on the reader
+		if err := reader.SetOffset(kafka.LastOffset); err != nil {
+			logger.Log.Error("set revocation reader offset", zap.Int("partition", partition), zap.Error(err))
+		}
+
+		// offsets of group-less readers aren't committed, acks only release the message
+		(&KafkaService{reader: reader, consumeCh: s.consumeCh}).Start(ctx)
+	}
+}
+
+// Send is a no-op, revocations are published by the sso service
+func (s *TokenRevokedService) Send(key string, msg []byte) {
+	logger.Log.Warn("token revoked broker is read-only, message dropped", zap.String("key", key))
+}
+
+func (s *TokenRevokedService) Receive() <-chan Message {
+	return s.consumeCh
+}
+
+// partitions of the topic. A topic which doesn't exist yet is created with a single
+// partition on the first publish, so the first partition is read if the lookup fails.
+func (s *TokenRevokedService) partitions(ctx context.Context) []int {
+	for _, broker := range s.brokers {
+		found, err := kafka.LookupPartitions(ctx, "tcp", broker, s.topic)
+		if err != nil || len(found) == 0 {
+			logger.Log.Warn("look up revocation partitions", zap.String("broker", broker), zap.Error(err))
+			continue
+		}
+
+		partitions := make([]int, 0, len(found))
+		for _, p := range found {
+			partitions = append(partitions, p.ID)
+		}
+		return partitions
+	}
+
+	return []int{0}
+}
+
+func NewOrderBroker(cfg Config) Service {
+	if cfg.Broker == BrokerMemory {
+		logger.Log.Warn("memory broker: events only reach services running in this process")
+		return NewMemoryService(defaultHub, cfg.Topics.OrderCompleted, cfg.Topics.OrderCreated)
+	}
+	return InitOrderKafka(cfg)
+}
+
+func NewLoyaltyBroker(cfg Config) Service {
+	if cfg.Broker == BrokerMemory {
+		logger.Log.Warn("memory broker: events only reach services running in this process")
+		return NewMemoryService(defaultHub, cfg.Topics.OrderCreated, cfg.Topics.OrderCompleted)
+	}
+	return InitLoyaltyKafka(cfg)
+}
+
+func NewOrderStatusBroker(cfg Config) Service {
+	if cfg.Broker == BrokerMemory {
+		return NewMemoryService(defaultHub, cfg.Topics.OrderStatus, "")
+	}
+	return InitStatusOrder(cfg)
+}
+
+func NewLoyaltyStatusBroker(cfg Config) Service {
+	if cfg.Broker == BrokerMemory {
+		return NewMemoryService(defaultHub, "", cfg.Topics.OrderStatus)
+	}
+	return InitStatusLoyalty(cfg)
+}
+
+// NewTokenRevokedBroker follows the revocations published by sso. With the memory broker
+// they only arrive if sso runs in the same process, e.g. in tools/devstack.
+func NewTokenRevokedBroker(cfg Config) Service {
+	if cfg.Broker == BrokerMemory {
+		return NewMemoryService(defaultHub, cfg.Topics.TokenRevoked, "")
+	}
+	return InitTokenRevoked(cfg)
+}
+
+// NewPublisher is used to write dead letters and to redrive them
+func NewPublisher(cfg Config) Publisher {
+	if cfg.Broker == BrokerMemory {
+		return defaultHub
+	}
+	return NewKafkaPublisher(cfg)
+}
+
+// NewEventPublisher publishes events in the configured encoding, e.g. from the outbox
+func NewEventPublisher(cfg Config) BatchPublisher {
+	if cfg.Broker == BrokerMemory {
+		return defaultHub
 	}
+	return NewKafkaPublisher(cfg).WithContentType(cfg.ContentType())
 }
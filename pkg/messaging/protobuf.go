@@ -0,0 +1,206 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/grpc-service/gen/go/events"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// content types negotiated through the kafka message header
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+
+	contentTypeHeader = "content-type"
+)
+
+// encodings selectable through configuration
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// payloadCodec converts the JSON payload of one event type to its protobuf message and back.
+// JSON stays the canonical form inside the services, protobuf is only a wire format.
+type payloadCodec struct {
+	schemaVersion int
+	toProto       func(payload json.RawMessage) (proto.Message, error)
+	fromProto     func(data []byte) (json.RawMessage, error)
+}
+
+var payloadCodecs = map[string]payloadCodec{
+	EventOrderCreated: {
+		schemaVersion: 1,
+		toProto: func(payload json.RawMessage) (proto.Message, error) {
+			var order models.Accrual
+			if err := json.Unmarshal(payload, &order); err != nil {
+				return nil, err
+			}
+			return &events.OrderCreated{
+				Order:      int64(order.AccrualOrderID),
+				UserId:     int64(order.UserID),
+				Status:     order.Status,
+				Accrual:    order.Accrual,
+				UploadedAt: timestampFromTime(order.UploadTime),
+			}, nil
+		},
+		fromProto: func(data []byte) (json.RawMessage, error) {
+			var msg events.OrderCreated
+			if err := proto.Unmarshal(data, &msg); err != nil {
+				return nil, err
+			}
+			return json.Marshal(models.Accrual{
+				AccrualOrderID: int(msg.Order),
+				UserID:         int(msg.UserId),
+				Status:         msg.Status,
+				Accrual:        msg.Accrual,
+				UploadTime:     timeFromTimestamp(msg.UploadedAt),
+			})
+		},
+	},
+	EventOrderCompleted: {
+		schemaVersion: 1,
+		toProto: func(payload json.RawMessage) (proto.Message, error) {
+			var order models.Accrual
+			if err := json.Unmarshal(payload, &order); err != nil {
+				return nil, err
+			}
+			return &events.OrderCompleted{
+				Order:      int64(order.AccrualOrderID),
+				UserId:     int64(order.UserID),
+				Status:     order.Status,
+				Accrual:    order.Accrual,
+				UploadedAt: timestampFromTime(order.UploadTime),
+			}, nil
+		},
+		fromProto: func(data []byte) (json.RawMessage, error) {
+			var msg events.OrderCompleted
+			if err := proto.Unmarshal(data, &msg); err != nil {
+				return nil, err
+			}
+			return json.Marshal(models.Accrual{
+				AccrualOrderID: int(msg.Order),
+				UserID:         int(msg.UserId),
+				Status:         msg.Status,
+				Accrual:        msg.Accrual,
+				UploadTime:     timeFromTimestamp(msg.UploadedAt),
+			})
+		},
+	},
+	EventOrderStatus: {
+		schemaVersion: 1,
+		toProto: func(payload json.RawMessage) (proto.Message, error) {
+			var update models.AccrualStatusUpdate
+			if err := json.Unmarshal(payload, &update); err != nil {
+				return nil, err
+			}
+			return &events.OrderStatusUpdated{
+				Order:   int64(update.OrderID),
+				Status:  update.Status,
+				Accrual: update.Accrual,
+			}, nil
+		},
+		fromProto: func(data []byte) (json.RawMessage, error) {
+			var msg events.OrderStatusUpdated
+			if err := proto.Unmarshal(data, &msg); err != nil {
+				return nil, err
+			}
+			return json.Marshal(models.AccrualStatusUpdate{
+				OrderID: int(msg.Order),
+				Status:  msg.Status,
+				Accrual: msg.Accrual,
+			})
+		},
+	},
+}
+
+// encodeProtobuf converts a JSON envelope into its protobuf form
+func encodeProtobuf(data []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	codec, ok := payloadCodecs[env.EventType]
+	if !ok || codec.schemaVersion != env.SchemaVersion {
+		return nil, fmt.Errorf("%w: no protobuf schema for %s v%d",
+			ErrUnsupportedVersion, env.EventType, env.SchemaVersion)
+	}
+
+	msg, err := codec.toProto(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&events.Envelope{
+		EventId:       env.EventID,
+		EventType:     env.EventType,
+		SchemaVersion: int32(env.SchemaVersion),
+		OccurredAt:    timestamppb.New(env.OccurredAt),
+		Producer:      env.Producer,
+		Payload:       payload,
+	})
+}
+
+// decodeProtobuf converts a protobuf envelope into the JSON form consumers work with
+func decodeProtobuf(data []byte) ([]byte, error) {
+	var msg events.Envelope
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	codec, ok := payloadCodecs[msg.EventType]
+	if !ok || codec.schemaVersion != int(msg.SchemaVersion) {
+		return nil, fmt.Errorf("%w: no protobuf schema for %s v%d",
+			ErrUnsupportedVersion, msg.EventType, msg.SchemaVersion)
+	}
+
+	payload, err := codec.fromProto(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		EventID:       msg.EventId,
+		EventType:     msg.EventType,
+		SchemaVersion: int(msg.SchemaVersion),
+		OccurredAt:    msg.OccurredAt.AsTime(),
+		Producer:      msg.Producer,
+		Payload:       payload,
+	})
+}
+
+func timestampFromTime(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func timeFromTimestamp(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+// contentType returns the value of the content-type header, JSON if it's missing
+func contentType(headers []kafka.Header) string {
+	for _, h := range headers {
+		if h.Key == contentTypeHeader {
+			return string(h.Value)
+		}
+	}
+	return ContentTypeJSON
+}
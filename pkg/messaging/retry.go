@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy describes how often a failed message is retried before dead-lettering
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying won't fix, e.g. a malformed payload
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm)
+}
+
+// Do calls fn until it succeeds, fails permanently or the attempts are used up,
+// doubling the backoff after every failure. It returns the number of attempts made.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) (int, error) {
+	attempts := max(p.Attempts, 1)
+	backoff := p.InitialBackoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || IsPermanent(err) || attempt >= attempts {
+			return attempt, err
+		}
+
+		logger.Log.Warn("attempt failed, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// DeadLetter is published to the dead-letter topic of a message's source topic
+type DeadLetter struct {
+	Topic    string    `json:"topic"`
+	Key      string    `json:"key,omitempty"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Payload  []byte    `json:"payload"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func DeadLetterTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// Handle runs handler for a message read from topic using the retry policy.
+// When it gives up, the message goes to the dead-letter topic along with the last error.
+// The returned error is non-nil only if the message could be neither handled nor dead-lettered.
+func Handle(
+	ctx context.Context,
+	policy RetryPolicy,
+	dlq Publisher,
+	topic string,
+	msg Message,
+	handler func(ctx context.Context, msg []byte) error,
+) error {
+	attempts, err := policy.Do(ctx, func(ctx context.Context) error {
+		return handler(ctx, msg.Value)
+	})
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		logger.Log.Warn("message handling interrupted", zap.String("topic", topic), zap.Error(err))
+		return err
+	}
+
+	logger.Log.Error("message handling failed, dead-lettering",
+		zap.String("topic", topic),
+		zap.Int("attempts", attempts),
+		zap.Error(err))
+
+	deadLetter, err := json.Marshal(DeadLetter{
+		Topic:    topic,
+		Key:      msg.Key,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Payload:  msg.Value,
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		logger.Log.Error("marshal dead letter", zap.Error(err))
+		return err
+	}
+
+	if err := dlq.Publish(ctx, DeadLetterTopic(topic), msg.Key, deadLetter); err != nil {
+		logger.Log.Error("publish dead letter", zap.String("topic", topic), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// Redrive reads dead letters from dead and publishes their original payload back
+// onto the source topic. It stops after limit messages (0 means no limit) or
+// when nothing arrives for idle, and returns how many messages were moved.
+// A dead letter is acknowledged only after it was republished.
+func Redrive(
+	ctx context.Context,
+	dead <-chan Message,
+	pub Publisher,
+	limit int,
+	idle time.Duration,
+) (int, error) {
+	moved := 0
+	for limit <= 0 || moved < limit {
+		var msg Message
+		select {
+		case <-ctx.Done():
+			return moved, ctx.Err()
+		case <-time.After(idle):
+			return moved, nil
+		case m, ok := <-dead:
+			if !ok {
+				return moved, nil
+			}
+			msg = m
+		}
+
+		var deadLetter DeadLetter
+		if err := json.Unmarshal(msg.Value, &deadLetter); err != nil {
+			logger.Log.Error("unmarshal dead letter", zap.Error(err))
+			msg.Nack()
+			return moved, err
+		}
+
+		if err := pub.Publish(ctx, deadLetter.Topic, deadLetter.Key, deadLetter.Payload); err != nil {
+			logger.Log.Error("redrive message", zap.String("topic", deadLetter.Topic), zap.Error(err))
+			msg.Nack()
+			return moved, err
+		}
+		msg.Ack()
+
+		logger.Log.Info("message redriven",
+			zap.String("topic", deadLetter.Topic),
+			zap.String("error", deadLetter.Error),
+			zap.Int("attempts", deadLetter.Attempts))
+		moved++
+	}
+
+	return moved, nil
+}
@@ -3,6 +3,8 @@ package middleware
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
@@ -41,7 +44,7 @@ func Logger() gin.HandlerFunc {
 			zap.String("path", path),
 			zap.Duration("duration", duration),
 			zap.String("Accept-Encoding", encoding),
-			zap.String("Request Body", string(body)),
+			zap.String("Request Body", loggedBody(c.Request, body)),
 		)
 		logger.Log.Info("HTTP Response",
 			zap.Int("status", c.Writer.Status()),
@@ -50,8 +53,50 @@ func Logger() gin.HandlerFunc {
 	}
 }
 
+// request fields which are never logged
+var sensitiveFields = map[string]bool{
+	"password":     true,
+	"old_password": true,
+	"new_password": true,
+	"token":        true,
+	// a logged refresh token could be exchanged for the session until it rotates
+	"refresh_token": true,
+}
+
+// loggedBody returns the request body with the values of sensitive fields replaced.
+// Compressed bodies aren't logged, they'd have to be decompressed to be redacted.
+func loggedBody(req *http.Request, body []byte) string {
+	if shouldDecompress(req) {
+		return "[compressed]"
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return string(body)
+	}
+
+	redacted := false
+	for field := range fields {
+		if sensitiveFields[field] {
+			fields[field] = json.RawMessage(`"[redacted]"`)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return string(body)
+	}
+
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return "[redacted]"
+	}
+	return string(out)
+}
+
+// event streams are left uncompressed, gzip would hold events back until its buffer fills up
 func shouldCompress(req *http.Request) bool {
-	return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+	return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") &&
+		!strings.Contains(req.Header.Get("Accept"), "text/event-stream")
 }
 
 func shouldDecompress(req *http.Request) bool {
@@ -96,7 +141,14 @@ func (w *gzipWriter) Write(b []byte) (int, error) {
 	return w.writer.Write(b)
 }
 
-func Auth() gin.HandlerFunc {
+// RevocationList tells whether a token was revoked before it expired
+type RevocationList interface {
+	Revoked(jti string, sessionID string) bool
+}
+
+// Auth verifies the jwt_token cookie with the key keyfunc selects by the token's kid,
+// revoked tokens are refused unless revoked is nil
+func Auth(keyfunc jwt.Keyfunc, revoked RevocationList) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString, err := c.Cookie("jwt_token")
 		if err != nil {
@@ -104,24 +156,44 @@ func Auth() gin.HandlerFunc {
 			return
 		}
 
-		claims := &struct {
-			jwt.RegisteredClaims
-			UserID int64 `json:"user_id"`
-		}{}
-		_, err = jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte("secret_key"), nil
-		})
+		claims := &jwtkeys.Claims{}
+		_, err = jwt.ParseWithClaims(tokenString, claims, keyfunc)
 		if err != nil {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
+		if revoked != nil && revoked.Revoked(claims.ID, claims.SessionID) {
+			logger.Log.Info("revoked token refused", zap.Int64("user_id", claims.UserID), zap.String("sid", claims.SessionID))
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
 		c.Set("userID", claims.UserID)
 
 		c.Next()
 	}
 }
 
+// header merchants authenticate with
+const MerchantKeyHeader = "X-Merchant-Key"
+
+// MerchantAuth guards the endpoints merchants feed the accrual engine through. User tokens
+// grant nothing there, every request without the merchant key is forbidden, and all of
+// them are if key is empty.
+func MerchantAuth(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.GetHeader(MerchantKeyHeader)
+		if key == "" || subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+			logger.Log.Warn("merchant request refused", zap.String("path", c.Request.URL.Path))
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Next()
+	}
+}
+
 var (
 	limiters = make(map[int64]*rate.Limiter)
 	mu       sync.Mutex
@@ -140,6 +212,53 @@ func getLimiter(userID int64) *rate.Limiter {
 	return limiter
 }
 
+// Limiters rate-limits by an arbitrary key, e.g. a client ip or a login. Limiters
+// idle for long enough to refill are dropped, so unique keys don't pile up.
+type Limiters struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*keyLimiter
+	prunedAt time.Time
+}
+
+type keyLimiter struct {
+	*rate.Limiter
+	seenAt time.Time
+}
+
+func NewLimiters(limit rate.Limit, burst int) *Limiters {
+	return &Limiters{limit: limit, burst: burst, limiters: make(map[string]*keyLimiter)}
+}
+
+// Allow reports whether a request with the key may happen now
+func (l *Limiters) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// a limiter is full again after this long, dropping it changes nothing
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	if now.Sub(l.prunedAt) > refill {
+		for k, limiter := range l.limiters {
+			if now.Sub(limiter.seenAt) > refill {
+				delete(l.limiters, k)
+			}
+		}
+		l.prunedAt = now
+	}
+
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = &keyLimiter{Limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = limiter
+	}
+	limiter.seenAt = now
+
+	return limiter.AllowN(now, 1)
+}
+
 func RateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		val, ok := c.Get("userID")
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
+)
+
+func TestLoggedBodyRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		secret string
+	}{
+		{"login", `{"login":"alice","password":"hunter2"}`, "hunter2"},
+		{"change password", `{"old_password":"old-secret","new_password":"new-secret"}`, "secret"},
+		{"reset", `{"token":"reset-token","new_password":"new-secret"}`, "reset-token"},
+		{"refresh", `{"refresh_token":"refresh-token"}`, "refresh-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			got := loggedBody(req, []byte(tt.body))
+			if strings.Contains(got, tt.secret) {
+				t.Errorf("logged body %s contains %q", got, tt.secret)
+			}
+			if !strings.Contains(got, "[redacted]") {
+				t.Errorf("logged body %s isn't redacted", got)
+			}
+		})
+	}
+}
+
+func TestLoggedBodyKeepsOtherBodies(t *testing.T) {
+	for _, body := range []string{`{"order":"12345678903"}`, `["79927398713"]`, `12345678903`} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if got := loggedBody(req, []byte(body)); got != body {
+			t.Errorf("logged body = %s, want %s", got, body)
+		}
+	}
+}
+
+func TestLoggedBodySkipsCompressed(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Content-Encoding", "gzip")
+	if got := loggedBody(req, []byte("\x1f\x8b...")); got != "[compressed]" {
+		t.Errorf("logged body = %q, want [compressed]", got)
+	}
+}
+
+func TestMerchantAuthForbidsUserTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys, err := jwtkeys.Generate(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken := signUserToken(t, keys)
+
+	const merchantKey = "merchant-key"
+	r := gin.New()
+	r.GET("/api/orders/:number", Auth(keys.Keyfunc, nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/api/goods", MerchantAuth(merchantKey), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		cookie string
+		header string
+		want   int
+	}{
+		{"user token on user route", http.MethodGet, "/api/orders/79927398713", userToken, "", http.StatusOK},
+		{"user token on merchant route", http.MethodPost, "/api/goods", userToken, "", http.StatusForbidden},
+		{"user token as merchant key", http.MethodPost, "/api/goods", "", userToken, http.StatusForbidden},
+		{"wrong merchant key", http.MethodPost, "/api/goods", "", "not-the-key", http.StatusForbidden},
+		{"merchant key", http.MethodPost, "/api/goods", "", merchantKey, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "jwt_token", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(MerchantKeyHeader, tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerchantAuthWithoutKeyForbidsEverything(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/api/goods", MerchantAuth(""), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodPost, "/api/goods", nil)
+	req.Header.Set(MerchantKeyHeader, "")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// signs an access token of an ordinary user, like sso does
+func signUserToken(t *testing.T, keys *jwtkeys.KeySet) string {
+	t.Helper()
+
+	key, err := keys.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := key.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(key.Method(), jwtkeys.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti-1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		UserID:    1,
+		SessionID: "1",
+	})
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
@@ -21,8 +21,17 @@ type Accrual struct {
 }
 
 type AccrualStatusUpdate struct {
-	OrderID int    `json:"order"`
-	Status  string `json:"status"`
+	OrderID int     `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
+
+// StatusChange is one entry of an order's status history
+type StatusChange struct {
+	From      string    `json:"from,omitempty"`
+	Status    string    `json:"status"`
+	Accrual   float64   `json:"accrual"`
+	ChangedAt time.Time `json:"changed_at"`
 }
 
 type Withdrawal struct {
@@ -31,3 +40,85 @@ type Withdrawal struct {
 	Sum           float64   `json:"sum"`
 	ProcessedTime time.Time `json:"processed_at"`
 }
+
+// order statuses, in lifecycle order
+const (
+	StatusNew        = "NEW"
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+	StatusInvalid    = "INVALID"
+)
+
+type OutboxMessage struct {
+	ID        int64     `json:"id"`
+	Topic     string    `json:"topic"`
+	Key       string    `json:"key"`
+	Payload   []byte    `json:"payload"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reward types of a merchant rule
+const (
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+type Reward struct {
+	Match      string  `json:"match"`
+	Reward     float64 `json:"reward"`
+	RewardType string  `json:"reward_type"`
+}
+
+type Good struct {
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+}
+
+// BalanceTopUp is an accrual credited to the user's balance
+type BalanceTopUp struct {
+	OrderID int     `json:"order"`
+	UserID  int     `json:"user_id"`
+	Sum     float64 `json:"sum"`
+}
+
+// delivery states of a webhook event
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+type WebhookSubscription struct {
+	ID         int64     `json:"id"`
+	UserID     int       `json:"user_id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"events"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int64      `json:"subscription_id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Payload        []byte     `json:"-"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	// target of the delivery, filled in when it's claimed for sending
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// RevokedToken rejects the access token with the jti, or every access token of the session.
+// It's kept until ExpiresAt, when all the tokens it covers have expired anyway.
+type RevokedToken struct {
+	JTI       string    `json:"jti,omitempty"`
+	SessionID string    `json:"sid,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
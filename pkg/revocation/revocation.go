@@ -0,0 +1,140 @@
+// Package revocation keeps a local copy of the sso revocation list,
+// so revoked tokens are rejected without a call per request.
+package revocation
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+// FetchFunc loads the full revocation list, e.g. AuthClient.RevokedTokens
+type FetchFunc func(ctx context.Context) ([]models.RevokedToken, error)
+
+// List is filled from the sso service on start and then kept up to date by
+// token revoked events. It is also reloaded every interval, so a lost event
+// delays a revocation instead of dropping it.
+type List struct {
+	fetch    FetchFunc
+	interval time.Duration
+
+	mu       sync.RWMutex
+	jtis     map[string]time.Time
+	sessions map[string]time.Time
+}
+
+func NewList(fetch FetchFunc, interval time.Duration) *List {
+	return &List{
+		fetch:    fetch,
+		interval: interval,
+		jtis:     make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+	}
+}
+
+// Revoked reports whether the token with the jti, or its session, was revoked
+func (l *List) Revoked(jti string, sessionID string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	if expiresAt, ok := l.jtis[jti]; ok && jti != "" && now.Before(expiresAt) {
+		return true
+	}
+	if expiresAt, ok := l.sessions[sessionID]; ok && sessionID != "" && now.Before(expiresAt) {
+		return true
+	}
+	return false
+}
+
+// Add puts a revocation on the list
+func (l *List) Add(revoked ...models.RevokedToken) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, token := range revoked {
+		if token.JTI != "" {
+			l.jtis[token.JTI] = token.ExpiresAt
+		}
+		if token.SessionID != "" {
+			l.sessions[token.SessionID] = token.ExpiresAt
+		}
+	}
+}
+
+// Run loads the list and applies revocations from events until ctx is done
+func (l *List) Run(ctx context.Context, events <-chan messaging.Message) {
+	logger.Log.Info("revocation list started!")
+
+	l.reload(ctx)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.reload(ctx)
+		case msg, ok := <-events:
+			if !ok {
+				logger.Log.Warn("revocation channel closed")
+				events = nil
+				continue
+			}
+			l.handle(msg)
+		}
+	}
+}
+
+func (l *List) handle(msg messaging.Message) {
+	// a malformed event can't be applied later either, the reload covers it
+	defer msg.Ack()
+
+	var revoked models.RevokedToken
+	if _, err := messaging.Unmarshal(msg.Value, messaging.EventTokenRevoked, &revoked); err != nil {
+		logger.Log.Error("unmarshal revoked token", zap.Error(err))
+		return
+	}
+
+	l.Add(revoked)
+	logger.Log.Info("token revoked", zap.String("jti", revoked.JTI), zap.String("sid", revoked.SessionID))
+}
+
+// reload merges the fetched list and drops expired revocations
+func (l *List) reload(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	revoked, err := l.fetch(ctx)
+	if err != nil {
+		// keep the cached list while the sso service is unavailable
+		logger.Log.Error("fetch revoked tokens", zap.Error(err))
+		return
+	}
+
+	l.Add(revoked...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for jti, expiresAt := range l.jtis {
+		if !now.Before(expiresAt) {
+			delete(l.jtis, jti)
+		}
+	}
+	for sessionID, expiresAt := range l.sessions {
+		if !now.Before(expiresAt) {
+			delete(l.sessions, sessionID)
+		}
+	}
+
+	logger.Log.Debug("revocation list reloaded", zap.Int("jtis", len(l.jtis)), zap.Int("sessions", len(l.sessions)))
+}
@@ -1,6 +1,28 @@
 CREATE TABLE IF NOT EXISTS orders (
 order_id BIGINT PRIMARY KEY,
 user_id INTEGER NOT NULL,
-status TEXT NOT NULL,
+status TEXT NOT NULL CHECK (status IN ('REGISTERED', 'PROCESSING', 'PROCESSED', 'INVALID')),
 accrual NUMERIC(10, 2) DEFAULT 0 CHECK (accrual >= 0)
-);
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS rewards (
+match TEXT PRIMARY KEY,
+reward NUMERIC(10, 2) NOT NULL CHECK (reward > 0),
+reward_type TEXT NOT NULL CHECK (reward_type IN ('%', 'pt'))
+);
+
+-- goods are matched case-insensitively, so matches differing only in case would be ambiguous
+CREATE UNIQUE INDEX IF NOT EXISTS rewards_match_lower_idx ON rewards (lower(match));
+
+CREATE TABLE IF NOT EXISTS registered_orders (
+order_id BIGINT PRIMARY KEY,
+registered_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS order_goods (
+order_id BIGINT NOT NULL REFERENCES registered_orders(order_id) ON DELETE CASCADE,
+description TEXT NOT NULL,
+price NUMERIC(10, 2) NOT NULL CHECK (price >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS order_goods_order_id_idx ON order_goods (order_id);
\ No newline at end of file
@@ -1,7 +1,60 @@
 CREATE TABLE IF NOT EXISTS accruals (
 accrual_order_id BIGINT PRIMARY KEY,
 user_id INTEGER,
-status TEXT NOT NULL,
+status TEXT NOT NULL CHECK (status IN ('NEW', 'PROCESSING', 'PROCESSED', 'INVALID')),
 accrual NUMERIC(10, 2) DEFAULT 0 CHECK (accrual >= 0),
 uploaded_at TIMESTAMP DEFAULT NOW()
 );
+
+CREATE INDEX IF NOT EXISTS accruals_user_uploaded_idx ON accruals (user_id, uploaded_at, accrual_order_id);
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+id BIGSERIAL PRIMARY KEY,
+accrual_order_id BIGINT NOT NULL REFERENCES accruals(accrual_order_id) ON DELETE CASCADE,
+from_status TEXT CHECK (from_status IN ('NEW', 'PROCESSING', 'PROCESSED', 'INVALID')),
+to_status TEXT NOT NULL CHECK (to_status IN ('NEW', 'PROCESSING', 'PROCESSED', 'INVALID')),
+accrual NUMERIC(10, 2) DEFAULT 0,
+changed_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (accrual_order_id, id);
+
+CREATE TABLE IF NOT EXISTS outbox (
+id BIGSERIAL PRIMARY KEY,
+topic TEXT NOT NULL,
+key TEXT NOT NULL DEFAULT '',
+payload BYTEA NOT NULL,
+created_at TIMESTAMP DEFAULT NOW(),
+sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (topic, id) WHERE sent_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+id BIGSERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL,
+url TEXT NOT NULL,
+event_types TEXT[] NOT NULL,
+secret TEXT NOT NULL,
+created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_user_idx ON webhook_subscriptions (user_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+id BIGSERIAL PRIMARY KEY,
+subscription_id BIGINT NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+event_id TEXT NOT NULL,
+event_type TEXT NOT NULL,
+payload BYTEA NOT NULL,
+status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+attempts INTEGER NOT NULL DEFAULT 0,
+response_status INTEGER,
+last_error TEXT,
+next_attempt_at TIMESTAMP DEFAULT NOW(),
+created_at TIMESTAMP DEFAULT NOW(),
+delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
@@ -11,4 +11,47 @@ order_id BIGINT PRIMARY KEY,
 user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
 sum NUMERIC(10, 2) NOT NULL CHECK (sum > 0),
 processed_at TIMESTAMP DEFAULT NOW()
-);
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS credited_orders (
+order_id BIGINT PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+sum NUMERIC(10, 2) NOT NULL CHECK (sum >= 0),
+credited_at TIMESTAMP DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS sessions (
+id BIGSERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+created_at TIMESTAMP DEFAULT NOW(),
+revoked_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+token_hash TEXT PRIMARY KEY,
+session_id BIGINT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+expires_at TIMESTAMP NOT NULL,
+created_at TIMESTAMP DEFAULT NOW(),
+used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+id BIGSERIAL PRIMARY KEY,
+jti TEXT NOT NULL DEFAULT '',
+session_id BIGINT REFERENCES sessions(id) ON DELETE CASCADE,
+expires_at TIMESTAMP NOT NULL,
+revoked_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_idx ON revoked_tokens (expires_at);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+token_hash TEXT PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+expires_at TIMESTAMP NOT NULL,
+created_at TIMESTAMP DEFAULT NOW(),
+used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_idx ON password_resets (user_id);
@@ -1,29 +1,18 @@
 package main
 
 import (
-	"os"
+	"context"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/paranoiachains/loyalty-api/pkg/logger"
-	"github.com/paranoiachains/loyalty-api/sso-service/internal/app"
+	"github.com/paranoiachains/loyalty-api/sso-service/service"
 )
 
 func main() {
-	auth := app.NewAuth(5000, time.Hour*1)
-	withdraw := app.NewWithdraw(5001)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	go auth.GRPCServer.MustRun()
-	go withdraw.GRPCServer.MustRun()
-
-	stop := make(chan os.Signal, 1)
-
-	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
-
-	<-stop
-
-	auth.GRPCServer.Stop()
-	withdraw.GRPCServer.Stop()
-	logger.Log.Info("gracefully stopped")
+	if err := service.Run(ctx); err != nil {
+		panic(err)
+	}
 }
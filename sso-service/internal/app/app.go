@@ -1,32 +1,72 @@
 package app
 
 import (
+	"net/http"
 	"time"
 
+	pkgapp "github.com/paranoiachains/loyalty-api/pkg/app"
 	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
 	grpcapp "github.com/paranoiachains/loyalty-api/sso-service/internal/app/grpc"
+	httpapp "github.com/paranoiachains/loyalty-api/sso-service/internal/app/http"
 	databaseauth "github.com/paranoiachains/loyalty-api/sso-service/internal/database/auth"
 	databasewithdraw "github.com/paranoiachains/loyalty-api/sso-service/internal/database/withdraw"
+	"github.com/paranoiachains/loyalty-api/sso-service/internal/lib/jwt"
+	"github.com/paranoiachains/loyalty-api/sso-service/internal/lib/notify"
 	"github.com/paranoiachains/loyalty-api/sso-service/internal/services/auth"
 	"github.com/paranoiachains/loyalty-api/sso-service/internal/services/withdraw"
 )
 
 type App struct {
 	GRPCServer *grpcapp.App
+	// serves the JWKS, only the auth app has one
+	HTTPServer *httpapp.App
 }
 
-func NewAuth(grpcPort int, tokenTTL time.Duration) *App {
+func NewAuth(grpcPort int, jwksPort int, tokenTTL time.Duration, refreshTTL time.Duration) *App {
 	db, err := databaseauth.NewStorage(flags.SSODatabaseDSN)
 	if err != nil {
 		panic(err)
 	}
 
-	authService := auth.New(db, db, tokenTTL)
+	keys, err := pkgapp.JWTKeys()
+	if err != nil {
+		panic(err)
+	}
+
+	messagingCfg := pkgapp.MessagingConfig(messaging.ProducerSSOService)
+
+	// without a notifier the reset rpcs are unimplemented
+	var notifier auth.Notifier
+	switch {
+	case flags.PasswordResetURL != "":
+		notifier = notify.HTTP{URL: flags.PasswordResetURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	case flags.PasswordResetLog:
+		notifier = notify.Log{}
+	default:
+		logger.Log.Warn("no password reset url is set, password reset is disabled")
+	}
+
+	authService := auth.New(
+		db,
+		db,
+		db,
+		db,
+		notifier,
+		jwt.NewKeyManager(keys),
+		tokenTTL,
+		refreshTTL,
+		flags.PasswordResetTTL,
+		messaging.NewPublisher(messagingCfg),
+		messagingCfg.Topics.TokenRevoked,
+	)
 
 	grpcApp := grpcapp.NewAuth(authService, grpcPort)
 
 	return &App{
 		GRPCServer: grpcApp,
+		HTTPServer: httpapp.New(keys, jwksPort),
 	}
 }
 
@@ -0,0 +1,61 @@
+package httpapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// App serves the public key set for services verifying tokens on their own
+type App struct {
+	server *http.Server
+}
+
+func New(keys *jwtkeys.KeySet, port int) *App {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(keys.JWKS()); err != nil {
+			logger.Log.Error("encode jwks", zap.Error(err))
+		}
+	})
+
+	return &App{
+		server: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux},
+	}
+}
+
+func (a *App) MustRun() {
+	if err := a.Run(); err != nil {
+		panic(err)
+	}
+}
+
+func (a *App) Run() error {
+	logger.Log.Info("http server started!", zap.String("addr", a.server.Addr))
+
+	if err := a.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (a *App) Stop() {
+	logger.Log.Info("stopping http server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.server.Shutdown(ctx); err != nil {
+		logger.Log.Error("shutdown http server", zap.Error(err))
+	}
+}
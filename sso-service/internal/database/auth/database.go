@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -14,6 +15,7 @@ import (
 
 var (
 	ErrUniqueUsername = errors.New("unique username must be set")
+	ErrUserNotFound   = errors.New("user not found")
 )
 
 type Storage struct {
@@ -67,7 +69,11 @@ func (s Storage) User(ctx context.Context, login string) (*models.User, error) {
 	row := s.db.QueryRowContext(ctx, query, login)
 
 	var user models.User
-	if err := row.Scan(&user.UserID, &user.Username, &user.Password, &user.Balance, &user.Withdrawn); err != nil {
+	err := row.Scan(&user.UserID, &user.Username, &user.Password, &user.Balance, &user.Withdrawn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
 		logger.Log.Error("retrieve user", zap.Error(err))
 		return nil, err
 	}
@@ -76,3 +82,94 @@ func (s Storage) User(ctx context.Context, login string) (*models.User, error) {
 
 	return &user, nil
 }
+
+func (s Storage) UserByID(ctx context.Context, userID int64) (*models.User, error) {
+	query := `
+	SELECT user_id, login, password, balance, withdrawn
+	FROM users
+	WHERE user_id = $1
+	`
+	logger.Log.Info("retrieving user from db...", zap.Int64("user_id", userID))
+
+	row := s.db.QueryRowContext(ctx, query, userID)
+
+	var user models.User
+	err := row.Scan(&user.UserID, &user.Username, &user.Password, &user.Balance, &user.Withdrawn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		logger.Log.Error("retrieve user", zap.Error(err))
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdatePassword sets the password of the user and revokes every other session in the same
+// transaction, the revocations last until expiresAt. It returns the ids of the revoked sessions.
+func (s Storage) UpdatePassword(
+	ctx context.Context,
+	userID int64,
+	sessionID int64,
+	passHash []byte,
+	expiresAt time.Time,
+) (revoked []int64, err error) {
+	querySession := `
+	SELECT revoked_at IS NOT NULL
+	FROM sessions
+	WHERE id = $1 AND user_id = $2
+	FOR UPDATE
+	`
+	queryPassword := `
+	UPDATE users
+	SET password = $2
+	WHERE user_id = $1
+	`
+	logger.Log.Info("updating password...", zap.Int64("user_id", userID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the session may have been revoked since the caller checked it
+	var sessionRevoked bool
+	err = tx.QueryRowContext(ctx, querySession, sessionID, userID).Scan(&sessionRevoked)
+	if errors.Is(err, sql.ErrNoRows) || sessionRevoked {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		logger.Log.Error("get session", zap.Error(err))
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, queryPassword, userID, string(passHash))
+	if err != nil {
+		logger.Log.Error("update password", zap.Error(err))
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	revoked, err = revokeUserSessions(ctx, tx, userID, sessionID, expiresAt)
+	if err != nil {
+		logger.Log.Error("revoke sessions", zap.Error(err))
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return nil, err
+	}
+
+	return revoked, nil
+}
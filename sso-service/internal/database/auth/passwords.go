@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrResetTokenNotFound = errors.New("password reset token not found")
+	ErrResetTokenExpired  = errors.New("password reset token expired")
+	ErrResetTokenUsed     = errors.New("password reset token was already used")
+)
+
+// CreatePasswordReset stores the hash of a reset token of the user
+func (s Storage) CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, ttl time.Duration) error {
+	logger.Log.Info("creating password reset...", zap.Int64("user_id", userID))
+
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO password_resets (token_hash, user_id, expires_at)
+	VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+	`, tokenHash, userID, int64(ttl.Seconds()))
+	if err != nil {
+		logger.Log.Error("create password reset", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// ResetPassword consumes the reset token and sets the new password of its user.
+// The other outstanding reset tokens of the user are invalidated and every session
+// is revoked until expiresAt in the same transaction.
+func (s Storage) ResetPassword(
+	ctx context.Context,
+	tokenHash string,
+	passHash []byte,
+	expiresAt time.Time,
+) (userID int64, revoked []int64, err error) {
+	querySelect := `
+	SELECT user_id, used_at IS NOT NULL, expires_at <= NOW()
+	FROM password_resets
+	WHERE token_hash = $1
+	FOR UPDATE
+	`
+	queryUse := `
+	UPDATE password_resets
+	SET used_at = NOW()
+	WHERE user_id = $1 AND used_at IS NULL
+	`
+	queryPassword := `
+	UPDATE users
+	SET password = $2
+	WHERE user_id = $1
+	`
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var used, expired bool
+	err = tx.QueryRowContext(ctx, querySelect, tokenHash).Scan(&userID, &used, &expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, ErrResetTokenNotFound
+	}
+	if err != nil {
+		logger.Log.Error("get password reset", zap.Error(err))
+		return 0, nil, err
+	}
+
+	switch {
+	case used:
+		return 0, nil, ErrResetTokenUsed
+	case expired:
+		return 0, nil, ErrResetTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, queryUse, userID); err != nil {
+		logger.Log.Error("mark password resets used", zap.Error(err))
+		return 0, nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, queryPassword, userID, string(passHash)); err != nil {
+		logger.Log.Error("update password", zap.Error(err))
+		return 0, nil, err
+	}
+
+	revoked, err = revokeUserSessions(ctx, tx, userID, 0, expiresAt)
+	if err != nil {
+		logger.Log.Error("revoke sessions", zap.Error(err))
+		return 0, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return 0, nil, err
+	}
+
+	return userID, revoked, nil
+}
@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used")
+	ErrSessionRevoked       = errors.New("session is revoked")
+)
+
+// CreateSession starts a session of the user with its first refresh token
+func (s Storage) CreateSession(ctx context.Context, userID int64, tokenHash string, ttl time.Duration) (sessionID int64, err error) {
+	logger.Log.Info("creating session...", zap.Int64("user_id", userID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+	INSERT INTO sessions (user_id)
+	VALUES ($1)
+	RETURNING id
+	`, userID).Scan(&sessionID)
+	if err != nil {
+		logger.Log.Error("create session", zap.Error(err))
+		return 0, err
+	}
+
+	if err := insertRefreshToken(ctx, tx, sessionID, tokenHash, ttl); err != nil {
+		logger.Log.Error("insert refresh token", zap.Error(err))
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return 0, err
+	}
+
+	return sessionID, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one of the same session.
+// A token can be exchanged only once: presenting a used token again means it leaked,
+// so the whole session is revoked and ErrRefreshTokenReused is returned along with
+// the id of the revoked session.
+func (s Storage) RotateRefreshToken(
+	ctx context.Context,
+	tokenHash string,
+	newTokenHash string,
+	ttl time.Duration,
+) (userID int64, sessionID int64, err error) {
+	querySelect := `
+	SELECT rt.session_id, s.user_id, rt.used_at IS NOT NULL, rt.expires_at <= NOW(), s.revoked_at IS NOT NULL
+	FROM refresh_tokens rt
+	JOIN sessions s ON s.id = rt.session_id
+	WHERE rt.token_hash = $1
+	FOR UPDATE
+	`
+	queryUse := `
+	UPDATE refresh_tokens
+	SET used_at = NOW()
+	WHERE token_hash = $1
+	`
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var used, expired, revoked bool
+	err = tx.QueryRowContext(ctx, querySelect, tokenHash).Scan(&sessionID, &userID, &used, &expired, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		logger.Log.Error("get refresh token", zap.Error(err))
+		return 0, 0, err
+	}
+
+	switch {
+	case revoked:
+		return 0, 0, ErrSessionRevoked
+	case used:
+		logger.Log.Warn("refresh token reuse detected, revoking session",
+			zap.Int64("session_id", sessionID),
+			zap.Int64("user_id", userID))
+
+		if err := revokeSession(ctx, tx, sessionID); err != nil {
+			logger.Log.Error("revoke session", zap.Error(err))
+			return 0, 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			logger.Log.Error("commit tx", zap.Error(err))
+			return 0, 0, err
+		}
+		return userID, sessionID, ErrRefreshTokenReused
+	case expired:
+		return 0, 0, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, queryUse, tokenHash); err != nil {
+		logger.Log.Error("mark refresh token used", zap.Error(err))
+		return 0, 0, err
+	}
+
+	if err := insertRefreshToken(ctx, tx, sessionID, newTokenHash, ttl); err != nil {
+		logger.Log.Error("insert refresh token", zap.Error(err))
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return 0, 0, err
+	}
+
+	return userID, sessionID, nil
+}
+
+// RevokeSession revokes the session's refresh tokens and adds the session
+// to the revocation list until expiresAt, jti is optional
+func (s Storage) RevokeSession(ctx context.Context, sessionID int64, jti string, expiresAt time.Time) error {
+	logger.Log.Info("revoking session...", zap.Int64("session_id", sessionID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, sessionID); err != nil {
+		logger.Log.Error("revoke session", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO revoked_tokens (jti, session_id, expires_at)
+	VALUES ($1, $2, $3)
+	`, jti, sessionID, expiresAt)
+	if err != nil {
+		logger.Log.Error("insert revoked token", zap.Error(err))
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// ActiveSessions returns the ids of the user's sessions which weren't revoked
+func (s Storage) ActiveSessions(ctx context.Context, userID int64) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id
+	FROM sessions
+	WHERE user_id = $1 AND revoked_at IS NULL
+	ORDER BY id
+	`, userID)
+	if err != nil {
+		logger.Log.Error("query sessions", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			logger.Log.Error("scan session", zap.Error(err))
+			return nil, err
+		}
+		sessions = append(sessions, id)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokedTokens returns the revocations which still cover unexpired tokens
+func (s Storage) RevokedTokens(ctx context.Context) ([]models.RevokedToken, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT jti, session_id, expires_at
+	FROM revoked_tokens
+	WHERE expires_at > NOW()
+	ORDER BY id
+	`)
+	if err != nil {
+		logger.Log.Error("query revoked tokens", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revoked []models.RevokedToken
+	for rows.Next() {
+		var (
+			token     models.RevokedToken
+			sessionID sql.NullInt64
+		)
+		if err := rows.Scan(&token.JTI, &sessionID, &token.ExpiresAt); err != nil {
+			logger.Log.Error("scan revoked token", zap.Error(err))
+			return nil, err
+		}
+		if sessionID.Valid {
+			token.SessionID = strconv.FormatInt(sessionID.Int64, 10)
+		}
+		revoked = append(revoked, token)
+	}
+
+	return revoked, rows.Err()
+}
+
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, sessionID int64, tokenHash string, ttl time.Duration) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO refresh_tokens (token_hash, session_id, expires_at)
+	VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+	`, tokenHash, sessionID, int64(ttl.Seconds()))
+	return err
+}
+
+// revokes every active session of the user except the kept one, which may be 0,
+// and adds them to the revocation list until expiresAt
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userID int64, keepSessionID int64, expiresAt time.Time) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, `
+	UPDATE sessions
+	SET revoked_at = NOW()
+	WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+	RETURNING id
+	`, userID, keepSessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revoked []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range revoked {
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, session_id, expires_at)
+		VALUES ('', $1, $2)
+		`, id, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revoked, nil
+}
+
+func revokeSession(ctx context.Context, tx *sql.Tx, sessionID int64) error {
+	_, err := tx.ExecContext(ctx, `
+	UPDATE sessions
+	SET revoked_at = NOW()
+	WHERE id = $1 AND revoked_at IS NULL
+	`, sessionID)
+	return err
+}
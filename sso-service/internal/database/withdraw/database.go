@@ -12,9 +12,13 @@ import (
 )
 
 var (
-	ErrNotEnough = errors.New("not enough points")
+	ErrNotEnough        = errors.New("not enough points")
+	ErrOrderAlreadyUsed = errors.New("order already used for a withdrawal")
 )
 
+// how many times a withdrawal is retried after a serialization failure
+const maxSerializationRetries = 3
+
 type Storage struct {
 	db *sql.DB
 }
@@ -29,27 +33,62 @@ func NewStorage(databaseDSN string) (*Storage, error) {
 	return &Storage{db: db}, nil
 }
 
+// TopUp credits the user once per accrual order. Applied is false when the
+// order had already been credited, in which case the balance is left untouched.
 func (s Storage) TopUp(
 	ctx context.Context,
+	order int64,
 	userID int64,
 	sum float64,
-) error {
-	query := `
+) (applied bool, err error) {
+	queryCredited := `
+	INSERT INTO credited_orders(order_id, user_id, sum)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (order_id) DO NOTHING
+	`
+	queryBalance := `
 	UPDATE users
 	SET balance = balance + $1
 	WHERE user_id = $2
 	`
-	logger.Log.Info("balance top up (db level)", zap.Int64("user_id", userID), zap.Float64("sum", sum))
+	logger.Log.Info("balance top up (db level)", zap.Int64("order_id", order), zap.Int64("user_id", userID), zap.Float64("sum", sum))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, queryCredited, order, userID, sum)
+	if err != nil {
+		logger.Log.Error("record credited order", zap.Error(err))
+		return false, err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted == 0 {
+		logger.Log.Info("order already credited", zap.Int64("order_id", order))
+		return false, nil
+	}
 
-	_, err := s.db.ExecContext(ctx, query, sum, userID)
+	_, err = tx.ExecContext(ctx, queryBalance, sum, userID)
 	if err != nil {
 		logger.Log.Error("top up db query", zap.Error(err))
-		return err
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return false, err
 	}
 
 	logger.Log.Info("balance top up successful", zap.Int64("user_id", userID), zap.Float64("sum", sum))
 
-	return nil
+	return true, nil
 }
 
 func (s Storage) Balance(
@@ -80,6 +119,38 @@ func (s Storage) Withdraw(
 	userID int64,
 	sum float64,
 ) error {
+	for attempt := 1; ; attempt++ {
+		err := s.withdraw(ctx, order, userID, sum)
+
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "40001" && attempt < maxSerializationRetries {
+			logger.Log.Warn("withdraw serialization failure, retrying", zap.Int("attempt", attempt))
+			continue
+		}
+		return err
+	}
+}
+
+// withdraw debits the balance and records the withdrawal in one serializable tx.
+// A repeated request for the same order, user and sum is treated as already applied.
+func (s Storage) withdraw(
+	ctx context.Context,
+	order int64,
+	userID int64,
+	sum float64,
+) error {
+	queryLock := `
+	SELECT balance
+	FROM users
+	WHERE user_id = $1
+	FOR UPDATE
+	`
+	// the sum is compared as numeric, a float read back from NUMERIC(10, 2) may differ from the request
+	queryExisting := `
+	SELECT user_id, sum = $2::numeric(10, 2)
+	FROM withdrawals
+	WHERE order_id = $1
+	`
 	queryWithdrawals := `
 	INSERT INTO withdrawals(order_id, user_id, sum)
 	VALUES ($1, $2, $3)
@@ -90,9 +161,43 @@ func (s Storage) Withdraw(
 	WHERE user_id = $2
 	`
 
-	logger.Log.Info("withdrawing, updating users table...")
+	logger.Log.Info("withdrawing, starting tx...", zap.Int64("order_id", order), zap.Int64("user_id", userID))
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		logger.Log.Error("begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance float64
+	if err := tx.QueryRowContext(ctx, queryLock, userID).Scan(&balance); err != nil {
+		logger.Log.Error("lock user row", zap.Error(err))
+		return err
+	}
+
+	var (
+		existingUserID int64
+		sameSum        bool
+	)
+	err = tx.QueryRowContext(ctx, queryExisting, order, sum).Scan(&existingUserID, &sameSum)
+	switch {
+	case err == nil:
+		if existingUserID == userID && sameSum {
+			logger.Log.Info("withdrawal already applied", zap.Int64("order_id", order))
+			return nil
+		}
+		return ErrOrderAlreadyUsed
+	case !errors.Is(err, sql.ErrNoRows):
+		logger.Log.Error("check existing withdrawal", zap.Error(err))
+		return err
+	}
+
+	if balance < sum {
+		return ErrNotEnough
+	}
 
-	_, err := s.db.ExecContext(ctx, queryBalance, sum, userID)
+	_, err = tx.ExecContext(ctx, queryBalance, sum, userID)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.ConstraintName == "balance_nonnegative" {
@@ -102,12 +207,21 @@ func (s Storage) Withdraw(
 		return err
 	}
 
-	_, err = s.db.ExecContext(ctx, queryWithdrawals, order, userID, sum)
+	_, err = tx.ExecContext(ctx, queryWithdrawals, order, userID, sum)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrOrderAlreadyUsed
+		}
 		logger.Log.Error("add withdraw instance", zap.Error(err))
 		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		logger.Log.Error("commit tx", zap.Error(err))
+		return err
+	}
+
 	return nil
 }
 
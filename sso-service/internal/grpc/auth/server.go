@@ -3,9 +3,12 @@ package auth
 import (
 	"context"
 	"errors"
+	"time"
 
 	sso "github.com/paranoiachains/loyalty-api/grpc-service/gen/go/sso"
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
 	database "github.com/paranoiachains/loyalty-api/sso-service/internal/database/auth"
 	"github.com/paranoiachains/loyalty-api/sso-service/internal/services/auth"
 	"go.uber.org/zap"
@@ -24,12 +27,19 @@ type Auth interface {
 		ctx context.Context,
 		login string,
 		password string,
-	) (token string, err error)
+	) (token string, refreshToken string, err error)
 	RegisterNewUser(
 		ctx context.Context,
 		login string,
 		password string,
-	) (userID int64, token string, err error)
+	) (userID int64, token string, refreshToken string, err error)
+	Refresh(ctx context.Context, refreshToken string) (token string, newRefreshToken string, err error)
+	Logout(ctx context.Context, token string) error
+	RevokedTokens(ctx context.Context) ([]models.RevokedToken, error)
+	ChangePassword(ctx context.Context, token string, oldPassword string, newPassword string) error
+	RequestPasswordReset(ctx context.Context, login string) error
+	ResetPassword(ctx context.Context, resetToken string, newPassword string) error
+	JWKS() jwtkeys.JWKS
 }
 
 func Register(gRPCServer *grpc.Server, auth Auth) {
@@ -48,7 +58,7 @@ func (s *serverAPI) Login(
 		return nil, status.Error(codes.InvalidArgument, "password is required")
 	}
 
-	token, err := s.auth.Login(ctx, in.Login, in.Password)
+	token, refreshToken, err := s.auth.Login(ctx, in.Login, in.Password)
 	if err != nil {
 		if errors.Is(err, auth.ErrWrongPassword) {
 			logger.Log.Debug("login", zap.Error(err))
@@ -57,7 +67,7 @@ func (s *serverAPI) Login(
 		return nil, status.Error(codes.Internal, "failed to login")
 	}
 
-	return &sso.LoginResponse{Token: token}, nil
+	return &sso.LoginResponse{Token: token, RefreshToken: refreshToken}, nil
 }
 
 func (s *serverAPI) Register(
@@ -72,7 +82,7 @@ func (s *serverAPI) Register(
 		return nil, status.Error(codes.InvalidArgument, "password is required")
 	}
 
-	id, token, err := s.auth.RegisterNewUser(ctx, in.Login, in.Password)
+	id, token, refreshToken, err := s.auth.RegisterNewUser(ctx, in.Login, in.Password)
 	if err != nil {
 		if errors.Is(err, database.ErrUniqueUsername) {
 			return nil, status.Error(codes.AlreadyExists, "such username already exists")
@@ -80,6 +90,157 @@ func (s *serverAPI) Register(
 		return nil, status.Error(codes.Internal, "failed to register")
 	}
 
-	return &sso.RegisterResponse{UserId: id, Token: token}, nil
+	return &sso.RegisterResponse{UserId: id, Token: token, RefreshToken: refreshToken}, nil
 
 }
+
+func (s *serverAPI) Refresh(
+	ctx context.Context,
+	in *sso.RefreshRequest,
+) (*sso.RefreshResponse, error) {
+	if in.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh token is required")
+	}
+
+	token, refreshToken, err := s.auth.Refresh(ctx, in.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	return &sso.RefreshResponse{Token: token, RefreshToken: refreshToken}, nil
+}
+
+func (s *serverAPI) Logout(
+	ctx context.Context,
+	in *sso.LogoutRequest,
+) (*sso.LogoutResponse, error) {
+	if in.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+
+	if err := s.auth.Logout(ctx, in.Token); err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return nil, status.Error(codes.Internal, "failed to logout")
+	}
+
+	return &sso.LogoutResponse{}, nil
+}
+
+func (s *serverAPI) RevokedTokens(
+	ctx context.Context,
+	in *sso.RevokedTokensRequest,
+) (*sso.RevokedTokensResponse, error) {
+	revoked, err := s.auth.RevokedTokens(ctx)
+	if err != nil {
+		logger.Log.Error("revoked tokens", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get revoked tokens")
+	}
+
+	tokens := make([]*sso.RevokedToken, 0, len(revoked))
+	for _, token := range revoked {
+		tokens = append(tokens, &sso.RevokedToken{
+			Jti:       token.JTI,
+			SessionId: token.SessionID,
+			ExpiresAt: token.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+
+	return &sso.RevokedTokensResponse{Tokens: tokens}, nil
+}
+
+func (s *serverAPI) ChangePassword(
+	ctx context.Context,
+	in *sso.ChangePasswordRequest,
+) (*sso.ChangePasswordResponse, error) {
+	if in.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+
+	if in.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "new password is required")
+	}
+
+	err := s.auth.ChangePassword(ctx, in.Token, in.OldPassword, in.NewPassword)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		if errors.Is(err, auth.ErrWrongPassword) {
+			return nil, status.Error(codes.PermissionDenied, "wrong password")
+		}
+		return nil, status.Error(codes.Internal, "failed to change password")
+	}
+
+	return &sso.ChangePasswordResponse{}, nil
+}
+
+func (s *serverAPI) RequestPasswordReset(
+	ctx context.Context,
+	in *sso.RequestPasswordResetRequest,
+) (*sso.RequestPasswordResetResponse, error) {
+	if in.Login == "" {
+		return nil, status.Error(codes.InvalidArgument, "login is required")
+	}
+
+	if err := s.auth.RequestPasswordReset(ctx, in.Login); err != nil {
+		if errors.Is(err, auth.ErrPasswordResetDisabled) {
+			return nil, status.Error(codes.Unimplemented, "password reset is disabled")
+		}
+		return nil, status.Error(codes.Internal, "failed to request password reset")
+	}
+
+	return &sso.RequestPasswordResetResponse{}, nil
+}
+
+func (s *serverAPI) ResetPassword(
+	ctx context.Context,
+	in *sso.ResetPasswordRequest,
+) (*sso.ResetPasswordResponse, error) {
+	if in.ResetToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "reset token is required")
+	}
+
+	if in.NewPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "new password is required")
+	}
+
+	if err := s.auth.ResetPassword(ctx, in.ResetToken, in.NewPassword); err != nil {
+		if errors.Is(err, auth.ErrInvalidResetToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid reset token")
+		}
+		if errors.Is(err, auth.ErrPasswordResetDisabled) {
+			return nil, status.Error(codes.Unimplemented, "password reset is disabled")
+		}
+		return nil, status.Error(codes.Internal, "failed to reset password")
+	}
+
+	return &sso.ResetPasswordResponse{}, nil
+}
+
+func (s *serverAPI) GetJWKS(
+	ctx context.Context,
+	in *sso.GetJWKSRequest,
+) (*sso.GetJWKSResponse, error) {
+	set := s.auth.JWKS()
+
+	keys := make([]*sso.JWK, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		keys = append(keys, &sso.JWK{
+			Kty: key.Kty,
+			Kid: key.Kid,
+			Alg: key.Alg,
+			Use: key.Use,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Crv,
+			X:   key.X,
+		})
+	}
+
+	return &sso.GetJWKSResponse{Keys: keys}, nil
+}
@@ -23,9 +23,10 @@ type serverAPI struct {
 type Withdraw interface {
 	TopUp(
 		ctx context.Context,
+		order int64,
 		userID int64,
 		sum float64,
-	) error
+	) (applied bool, err error)
 	Balance(
 		ctx context.Context,
 		userID int64,
@@ -50,13 +51,18 @@ func (s *serverAPI) TopUp(
 	ctx context.Context,
 	in *sso.TopUpRequest,
 ) (*sso.TopUpResponse, error) {
-	logger.Log.Info("balance top up (grpc level)", zap.Int64("user_id", in.UserId), zap.Float64("sum", in.Sum))
+	logger.Log.Info("balance top up (grpc level)", zap.Int64("order", in.Order), zap.Int64("user_id", in.UserId), zap.Float64("sum", in.Sum))
+
+	if in.Order == 0 {
+		return nil, status.Error(codes.InvalidArgument, "order is required")
+	}
 
-	if err := s.withdraw.TopUp(ctx, in.UserId, in.Sum); err != nil {
+	applied, err := s.withdraw.TopUp(ctx, in.Order, in.UserId, in.Sum)
+	if err != nil {
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
-	return &sso.TopUpResponse{}, nil
+	return &sso.TopUpResponse{Applied: applied}, nil
 }
 
 func (s *serverAPI) Balance(
@@ -81,6 +87,9 @@ func (s *serverAPI) Withdraw(
 		if errors.Is(err, database.ErrNotEnough) {
 			return nil, status.Error(codes.Canceled, "not enough points")
 		}
+		if errors.Is(err, database.ErrOrderAlreadyUsed) {
+			return nil, status.Error(codes.AlreadyExists, "order already used for a withdrawal")
+		}
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
@@ -1,29 +1,87 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
 	"go.uber.org/zap"
 )
 
-func BuildJWTToken(userID int64) (string, error) {
+// KeyManager signs tokens with the active key of the key set. Rotating a key means
+// adding a new active key to the key set file and retiring the old one, tokens signed
+// with the old key are accepted until they expire.
+type KeyManager struct {
+	keys *jwtkeys.KeySet
+}
+
+func NewKeyManager(keys *jwtkeys.KeySet) *KeyManager {
+	return &KeyManager{keys: keys}
+}
+
+// Keys returns the key set, e.g. to verify tokens
+func (m *KeyManager) Keys() *jwtkeys.KeySet {
+	return m.keys
+}
+
+// BuildJWTToken issues an access token of the session, every token gets a unique jti
+func (m *KeyManager) BuildJWTToken(userID int64, sessionID int64, ttl time.Duration) (string, error) {
 	logger.Log.Info("building jwt token...")
 
-	token := jwt.New(jwt.SigningMethodHS256)
+	key, err := m.keys.Active()
+	if err != nil {
+		logger.Log.Error("get active signing key", zap.Error(err))
+		return "", err
+	}
 
-	claims := token.Claims.(jwt.MapClaims)
-	claims["user_id"] = userID
-	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	signingKey, err := key.SigningKey()
+	if err != nil {
+		logger.Log.Error("get signing key", zap.Error(err))
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		logger.Log.Error("generate jti", zap.Error(err))
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(key.Method(), jwtkeys.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		UserID:    userID,
+		SessionID: strconv.FormatInt(sessionID, 10),
+	})
+	token.Header["kid"] = key.ID
 
-	tokenString, err := token.SignedString([]byte("secret_key"))
+	tokenString, err := token.SignedString(signingKey)
 	if err != nil {
 		logger.Log.Error("signing token", zap.Error(err))
 		return "", err
 	}
 
-	logger.Log.Info("successfully built jwt token!")
+	logger.Log.Info("successfully built jwt token!", zap.String("kid", key.ID))
 
 	return tokenString, nil
 }
+
+// ParseJWTToken verifies the signature of a token issued by this service. Expiration
+// isn't checked, so an expired token still identifies the session it belongs to.
+func (m *KeyManager) ParseJWTToken(tokenString string) (*jwtkeys.Claims, error) {
+	claims := &jwtkeys.Claims{}
+	parser := jwt.Parser{SkipClaimsValidation: true}
+
+	if _, err := parser.ParseWithClaims(tokenString, claims, m.keys.Keyfunc); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,65 @@
+// Package notify delivers password reset tokens to users
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// PasswordReset is what a notifier hands over to the user
+type PasswordReset struct {
+	UserID    int64     `json:"user_id"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Log only records that a reset was issued, it's meant for development. The token is
+// never written to the log, so nobody reading it can take over the account.
+type Log struct{}
+
+func (Log) PasswordReset(ctx context.Context, reset PasswordReset) error {
+	logger.Log.Warn("password reset issued, it isn't delivered to the user",
+		zap.String("login", reset.Login),
+		zap.Time("expires_at", reset.ExpiresAt))
+	return nil
+}
+
+// HTTP posts reset tokens as JSON to a service which knows how to reach the user,
+// e.g. an email or sms gateway
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n HTTP) PasswordReset(ctx context.Context, reset PasswordReset) error {
+	body, err := json.Marshal(reset)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notifier responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
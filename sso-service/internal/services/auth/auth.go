@@ -2,19 +2,33 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/paranoiachains/loyalty-api/pkg/jwtkeys"
 	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
 	"github.com/paranoiachains/loyalty-api/pkg/models"
 	database "github.com/paranoiachains/loyalty-api/sso-service/internal/database/auth"
 	"github.com/paranoiachains/loyalty-api/sso-service/internal/lib/jwt"
+	"github.com/paranoiachains/loyalty-api/sso-service/internal/lib/notify"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	ErrWrongPassword = errors.New("wrong password")
+	ErrWrongPassword       = errors.New("wrong password")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrInvalidResetToken   = errors.New("invalid password reset token")
+	// no notifier is configured, so reset tokens couldn't reach their users
+	ErrPasswordResetDisabled = errors.New("password reset is disabled")
 )
 
 type UserSaver interface {
@@ -23,37 +37,106 @@ type UserSaver interface {
 		login string,
 		passHash []byte,
 	) (uid int64, err error)
+	// UpdatePassword revokes every session of the user but sessionID along with the password change
+	UpdatePassword(
+		ctx context.Context,
+		userID int64,
+		sessionID int64,
+		passHash []byte,
+		expiresAt time.Time,
+	) (revoked []int64, err error)
 }
 
 type UserProvider interface {
 	User(ctx context.Context, login string) (*models.User, error)
+	UserByID(ctx context.Context, userID int64) (*models.User, error)
+}
+
+// SessionStore keeps refresh tokens by their hash, the tokens themselves are never stored
+type SessionStore interface {
+	CreateSession(ctx context.Context, userID int64, tokenHash string, ttl time.Duration) (sessionID int64, err error)
+	RotateRefreshToken(
+		ctx context.Context,
+		tokenHash string,
+		newTokenHash string,
+		ttl time.Duration,
+	) (userID int64, sessionID int64, err error)
+	RevokeSession(ctx context.Context, sessionID int64, jti string, expiresAt time.Time) error
+	RevokedTokens(ctx context.Context) ([]models.RevokedToken, error)
+	ActiveSessions(ctx context.Context, userID int64) ([]int64, error)
+}
+
+// PasswordResetStore keeps reset tokens by their hash, like SessionStore
+type PasswordResetStore interface {
+	CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, ttl time.Duration) error
+	// ResetPassword revokes every session of the user along with the password change
+	ResetPassword(
+		ctx context.Context,
+		tokenHash string,
+		passHash []byte,
+		expiresAt time.Time,
+	) (userID int64, revoked []int64, err error)
+}
+
+// Notifier delivers a password reset token to the user
+type Notifier interface {
+	PasswordReset(ctx context.Context, reset notify.PasswordReset) error
 }
 
 type Auth struct {
 	usrSaver    UserSaver
 	usrProvider UserProvider
+	sessions    SessionStore
+	resets      PasswordResetStore
+	notifier    Notifier
+	keys        *jwt.KeyManager
 	tokenTTL    time.Duration
+	refreshTTL  time.Duration
+	resetTTL    time.Duration
+	// revocations are published to revokedTopic, so services drop them from their caches
+	events       messaging.Publisher
+	revokedTopic string
 }
 
 func New(
 	userSaver UserSaver,
 	userProvider UserProvider,
+	sessions SessionStore,
+	resets PasswordResetStore,
+	notifier Notifier,
+	keys *jwt.KeyManager,
 	tokenTTL time.Duration,
+	refreshTTL time.Duration,
+	resetTTL time.Duration,
+	events messaging.Publisher,
+	revokedTopic string,
 ) *Auth {
 	return &Auth{
-		usrSaver:    userSaver,
-		usrProvider: userProvider,
-		tokenTTL:    tokenTTL,
+		usrSaver:     userSaver,
+		usrProvider:  userProvider,
+		sessions:     sessions,
+		resets:       resets,
+		notifier:     notifier,
+		keys:         keys,
+		tokenTTL:     tokenTTL,
+		refreshTTL:   refreshTTL,
+		resetTTL:     resetTTL,
+		events:       events,
+		revokedTopic: revokedTopic,
 	}
 }
 
-func (a *Auth) RegisterNewUser(ctx context.Context, login string, password string) (userID int64, token string, err error) {
+func (a *Auth) RegisterNewUser(
+	ctx context.Context,
+	login string,
+	password string,
+) (userID int64, token string, refreshToken string, err error) {
 	logger.Log.Info("registering user...")
 
 	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		logger.Log.Error("generate hash from password", zap.Error(err))
-		return 0, "", err
+		return 0, "", "", err
 	}
 
 	userID, err = a.usrSaver.SaveUser(ctx, login, passHash)
@@ -61,42 +144,345 @@ func (a *Auth) RegisterNewUser(ctx context.Context, login string, password strin
 		logger.Log.Error("save user", zap.Error(err))
 
 		if errors.Is(err, database.ErrUniqueUsername) {
-			return 0, "", database.ErrUniqueUsername
+			return 0, "", "", database.ErrUniqueUsername
 		}
-		return 0, "", err
+		return 0, "", "", err
 	}
 
-	token, err = jwt.BuildJWTToken(userID)
+	token, refreshToken, err = a.startSession(ctx, userID)
 	if err != nil {
-		return 0, "", err
+		return 0, "", "", err
 	}
 
-	return userID, token, nil
+	return userID, token, refreshToken, nil
 }
 
-func (a *Auth) Login(ctx context.Context, login string, password string) (token string, err error) {
+func (a *Auth) Login(ctx context.Context, login string, password string) (token string, refreshToken string, err error) {
 	logger.Log.Info("logging in", zap.String("login", login))
 
 	user, err := a.usrProvider.User(ctx, login)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(password)); err != nil {
 		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
 			logger.Log.Error("bcrypt", zap.Error(err))
-			return "", ErrWrongPassword
+			return "", "", ErrWrongPassword
 		}
 		logger.Log.Error("bcrypt (unknown err)", zap.Error(err))
-		return "", err
+		return "", "", err
 	}
 
-	token, err = jwt.BuildJWTToken(user.UserID)
+	token, refreshToken, err = a.startSession(ctx, user.UserID)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	logger.Log.Info("user logged in", zap.String("user", login))
 
-	return token, nil
+	return token, refreshToken, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token.
+// Every refresh token is single-use, a reused one revokes its whole session.
+func (a *Auth) Refresh(ctx context.Context, refreshToken string) (token string, newRefreshToken string, err error) {
+	logger.Log.Info("refreshing token...")
+
+	newRefreshToken, err = newOpaqueToken()
+	if err != nil {
+		logger.Log.Error("generate refresh token", zap.Error(err))
+		return "", "", err
+	}
+
+	userID, sessionID, err := a.sessions.RotateRefreshToken(
+		ctx,
+		hashToken(refreshToken),
+		hashToken(newRefreshToken),
+		a.refreshTTL,
+	)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		// the session was revoked, its access tokens have to be rejected as well
+		logger.Log.Warn("refresh token rejected", zap.Error(err))
+		if err := a.revoke(ctx, sessionID, ""); err != nil {
+			logger.Log.Error("revoke session", zap.Error(err))
+		}
+		return "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrRefreshTokenNotFound) ||
+			errors.Is(err, database.ErrRefreshTokenExpired) ||
+			errors.Is(err, database.ErrSessionRevoked) {
+			logger.Log.Warn("refresh token rejected", zap.Error(err))
+			return "", "", ErrInvalidRefreshToken
+		}
+		logger.Log.Error("rotate refresh token", zap.Error(err))
+		return "", "", err
+	}
+
+	token, err = a.keys.BuildJWTToken(userID, sessionID, a.tokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Log.Info("token refreshed", zap.Int64("user_id", userID), zap.Int64("session_id", sessionID))
+
+	return token, newRefreshToken, nil
+}
+
+// Logout revokes the session of the access token, its refresh tokens can't be used anymore
+// and its access tokens are rejected by every service within seconds
+func (a *Auth) Logout(ctx context.Context, token string) error {
+	logger.Log.Info("logging out...")
+
+	claims, err := a.keys.ParseJWTToken(token)
+	if err != nil {
+		logger.Log.Warn("parse token", zap.Error(err))
+		return ErrInvalidToken
+	}
+
+	// tokens issued before sessions were introduced can't be revoked
+	sessionID, err := strconv.ParseInt(claims.SessionID, 10, 64)
+	if err != nil {
+		logger.Log.Warn("token without session", zap.Int64("user_id", claims.UserID))
+		return ErrInvalidToken
+	}
+
+	if err := a.revoke(ctx, sessionID, claims.ID); err != nil {
+		return err
+	}
+
+	logger.Log.Info("user logged out", zap.Int64("user_id", claims.UserID), zap.Int64("session_id", sessionID))
+
+	return nil
+}
+
+// ChangePassword sets a new password of the token's user. The old password has to match,
+// every other session of the user is revoked.
+func (a *Auth) ChangePassword(ctx context.Context, token string, oldPassword string, newPassword string) error {
+	logger.Log.Info("changing password...")
+
+	claims, err := a.keys.ParseJWTToken(token)
+	if err != nil || !claims.VerifyExpiresAt(time.Now(), true) {
+		logger.Log.Warn("parse token", zap.Error(err))
+		return ErrInvalidToken
+	}
+
+	sessionID, err := strconv.ParseInt(claims.SessionID, 10, 64)
+	if err != nil {
+		logger.Log.Warn("token without session", zap.Int64("user_id", claims.UserID))
+		return ErrInvalidToken
+	}
+
+	sessions, err := a.sessions.ActiveSessions(ctx, claims.UserID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(sessions, sessionID) {
+		logger.Log.Warn("session is revoked", zap.Int64("session_id", sessionID))
+		return ErrInvalidToken
+	}
+
+	user, err := a.usrProvider.UserByID(ctx, claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(oldPassword)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			logger.Log.Error("bcrypt", zap.Error(err))
+			return ErrWrongPassword
+		}
+		logger.Log.Error("bcrypt (unknown err)", zap.Error(err))
+		return err
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Log.Error("generate hash from password", zap.Error(err))
+		return err
+	}
+
+	// the password and the revocations are committed together, events follow
+	expiresAt := time.Now().Add(a.tokenTTL).UTC()
+	revoked, err := a.usrSaver.UpdatePassword(ctx, user.UserID, sessionID, passHash, expiresAt)
+	if errors.Is(err, database.ErrSessionRevoked) {
+		logger.Log.Warn("session is revoked", zap.Int64("session_id", sessionID))
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range revoked {
+		a.publishRevoked(ctx, models.RevokedToken{SessionID: strconv.FormatInt(id, 10), ExpiresAt: expiresAt})
+	}
+
+	logger.Log.Info("password changed", zap.Int64("user_id", user.UserID))
+
+	return nil
+}
+
+// RequestPasswordReset issues a single-use reset token and hands it to the notifier in the
+// background. Neither an unknown login nor a failed notification is reported, so the call
+// can't be used to look up users.
+func (a *Auth) RequestPasswordReset(ctx context.Context, login string) error {
+	if a.notifier == nil {
+		return ErrPasswordResetDisabled
+	}
+
+	logger.Log.Info("requesting password reset", zap.String("login", login))
+
+	user, err := a.usrProvider.User(ctx, login)
+	if errors.Is(err, database.ErrUserNotFound) {
+		logger.Log.Info("password reset for unknown user", zap.String("login", login))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		logger.Log.Error("generate reset token", zap.Error(err))
+		return err
+	}
+
+	if err := a.resets.CreatePasswordReset(ctx, user.UserID, hashToken(token), a.resetTTL); err != nil {
+		return err
+	}
+
+	reset := notify.PasswordReset{
+		UserID:    user.UserID,
+		Login:     user.Username,
+		Token:     token,
+		ExpiresAt: time.Now().Add(a.resetTTL).UTC(),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := a.notifier.PasswordReset(ctx, reset); err != nil {
+			logger.Log.Error("notify password reset", zap.Int64("user_id", reset.UserID), zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword consumes a reset token and sets the new password,
+// every session of the user is revoked
+func (a *Auth) ResetPassword(ctx context.Context, resetToken string, newPassword string) error {
+	if a.notifier == nil {
+		return ErrPasswordResetDisabled
+	}
+
+	logger.Log.Info("resetting password...")
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Log.Error("generate hash from password", zap.Error(err))
+		return err
+	}
+
+	expiresAt := time.Now().Add(a.tokenTTL).UTC()
+	userID, revoked, err := a.resets.ResetPassword(ctx, hashToken(resetToken), passHash, expiresAt)
+	if err != nil {
+		if errors.Is(err, database.ErrResetTokenNotFound) ||
+			errors.Is(err, database.ErrResetTokenExpired) ||
+			errors.Is(err, database.ErrResetTokenUsed) {
+			logger.Log.Warn("reset token rejected", zap.Error(err))
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+
+	for _, id := range revoked {
+		a.publishRevoked(ctx, models.RevokedToken{SessionID: strconv.FormatInt(id, 10), ExpiresAt: expiresAt})
+	}
+
+	logger.Log.Info("password reset", zap.Int64("user_id", userID))
+
+	return nil
+}
+
+// RevokedTokens returns the revocation list, services load it on start
+func (a *Auth) RevokedTokens(ctx context.Context) ([]models.RevokedToken, error) {
+	return a.sessions.RevokedTokens(ctx)
+}
+
+// revokes the session and announces it. Access tokens of the session expire within
+// the token ttl, so the revocation isn't needed after that.
+func (a *Auth) revoke(ctx context.Context, sessionID int64, jti string) error {
+	revoked := models.RevokedToken{
+		JTI:       jti,
+		SessionID: strconv.FormatInt(sessionID, 10),
+		ExpiresAt: time.Now().Add(a.tokenTTL).UTC(),
+	}
+
+	if err := a.sessions.RevokeSession(ctx, sessionID, jti, revoked.ExpiresAt); err != nil {
+		logger.Log.Error("revoke session", zap.Error(err))
+		return err
+	}
+
+	a.publishRevoked(ctx, revoked)
+	return nil
+}
+
+// announces a stored revocation. Services also reload the list periodically,
+// so a lost event only delays the revocation.
+func (a *Auth) publishRevoked(ctx context.Context, revoked models.RevokedToken) {
+	if a.events == nil {
+		return
+	}
+
+	payload, err := messaging.Marshal(messaging.EventTokenRevoked, messaging.ProducerSSOService, revoked)
+	if err != nil {
+		logger.Log.Error("marshal revoked token", zap.Error(err))
+		return
+	}
+	if err := a.events.Publish(ctx, a.revokedTopic, revoked.SessionID, payload); err != nil {
+		logger.Log.Error("publish revoked token", zap.Error(err))
+	}
+}
+
+// issues the first token pair of a new session
+func (a *Auth) startSession(ctx context.Context, userID int64) (token string, refreshToken string, err error) {
+	refreshToken, err = newOpaqueToken()
+	if err != nil {
+		logger.Log.Error("generate refresh token", zap.Error(err))
+		return "", "", err
+	}
+
+	sessionID, err := a.sessions.CreateSession(ctx, userID, hashToken(refreshToken), a.refreshTTL)
+	if err != nil {
+		logger.Log.Error("create session", zap.Error(err))
+		return "", "", err
+	}
+
+	token, err = a.keys.BuildJWTToken(userID, sessionID, a.tokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// refresh tokens are random, so a plain hash is enough to keep them from leaking with the database
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// JWKS returns the public keys tokens can be verified with
+func (a *Auth) JWKS() jwtkeys.JWKS {
+	return a.keys.Keys().JWKS()
 }
@@ -15,9 +15,10 @@ import (
 type BalanceGetter interface {
 	TopUp(
 		ctx context.Context,
+		order int64,
 		userID int64,
 		sum float64,
-	) error
+	) (applied bool, err error)
 	Balance(
 		ctx context.Context,
 		userID int64,
@@ -53,17 +54,19 @@ func New(
 
 func (w *Withdraw) TopUp(
 	ctx context.Context,
+	order int64,
 	userID int64,
 	sum float64,
-) error {
-	logger.Log.Info("balance top up (service lvl)", zap.Int64("user_id", userID), zap.Float64("sum", sum))
+) (applied bool, err error) {
+	logger.Log.Info("balance top up (service lvl)", zap.Int64("order_id", order), zap.Int64("user_id", userID), zap.Float64("sum", sum))
 
-	if err := w.balanceGetter.TopUp(ctx, userID, sum); err != nil {
+	applied, err = w.balanceGetter.TopUp(ctx, order, userID, sum)
+	if err != nil {
 		logger.Log.Error("top up", zap.Error(err))
-		return err
+		return false, err
 	}
 
-	return nil
+	return applied, nil
 }
 
 func (w *Withdraw) Balance(
@@ -0,0 +1,39 @@
+// Package service runs sso-service. It is importable from outside the service,
+// so tools/devstack can run it in one process with order-service and loyalty-service.
+package service
+
+import (
+	"context"
+
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/sso-service/internal/app"
+)
+
+// Run serves auth on :5000, withdrawals on :5001 and the jwks on :5002 until ctx
+// is done or one of the servers fails
+func Run(ctx context.Context) error {
+	auth := app.NewAuth(5000, 5002, flags.JWTTokenTTL, flags.RefreshTokenTTL)
+	withdraw := app.NewWithdraw(5001)
+
+	servers := []func() error{auth.GRPCServer.Run, auth.HTTPServer.Run, withdraw.GRPCServer.Run}
+	failed := make(chan error, len(servers))
+	for _, run := range servers {
+		go func() {
+			failed <- run()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-failed:
+	case <-ctx.Done():
+	}
+
+	auth.GRPCServer.Stop()
+	auth.HTTPServer.Stop()
+	withdraw.GRPCServer.Stop()
+	logger.Log.Info("gracefully stopped")
+
+	return err
+}
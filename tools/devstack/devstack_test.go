@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	loyaltyservice "github.com/paranoiachains/loyalty-api/loyalty-service/service"
+	orderservice "github.com/paranoiachains/loyalty-api/order-service/service"
+	"github.com/paranoiachains/loyalty-api/pkg/database"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"github.com/paranoiachains/loyalty-api/pkg/models"
+)
+
+// memStore keeps the orders of one service, status changes follow the status model
+// like in postgres. Methods the processors don't call are left to the nil Storage.
+type memStore struct {
+	database.Storage
+
+	mu      sync.Mutex
+	initial string
+	orders  map[int]*models.Accrual
+	history map[int][]string
+	outbox  []models.OutboxMessage
+	sent    int
+	goods   map[int][]models.Good
+	rewards []models.Reward
+}
+
+func newMemStore(initial string) *memStore {
+	return &memStore{
+		initial: initial,
+		orders:  make(map[int]*models.Accrual),
+		history: make(map[int][]string),
+		goods:   make(map[int][]models.Good),
+	}
+}
+
+// CreateAccrual returns the existing order on a redelivery like the loyalty storage does,
+// a new order is enqueued as an order-created event like in the order storage
+func (s *memStore) CreateAccrual(ctx context.Context, accrualOrderID int, userID int) (*models.Accrual, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order, ok := s.orders[accrualOrderID]; ok {
+		copied := *order
+		return &copied, nil
+	}
+
+	now := time.Now()
+	order := &models.Accrual{AccrualOrderID: accrualOrderID, UserID: userID, Status: s.initial, UploadTime: &now}
+	s.orders[accrualOrderID] = order
+	s.history[accrualOrderID] = []string{s.initial}
+
+	payload, err := messaging.Marshal(messaging.EventOrderCreated, messaging.ProducerOrderService, order)
+	if err != nil {
+		return nil, err
+	}
+	s.outbox = append(s.outbox, models.OutboxMessage{
+		ID:      int64(len(s.outbox) + 1),
+		Topic:   messaging.TopicOrderCreated,
+		Key:     strconv.Itoa(accrualOrderID),
+		Payload: payload,
+	})
+
+	copied := *order
+	return &copied, nil
+}
+
+func (s *memStore) SetStatus(ctx context.Context, accrualOrderID int, status string) error {
+	return s.setStatus(accrualOrderID, status, nil)
+}
+
+func (s *memStore) SetStatusWithAccrual(ctx context.Context, accrualOrderID int, status string, accrual float64) error {
+	return s.setStatus(accrualOrderID, status, &accrual)
+}
+
+func (s *memStore) setStatus(accrualOrderID int, status string, accrual *float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[accrualOrderID]
+	if !ok {
+		return database.ErrOrderNotFound
+	}
+	if err := database.ValidateTransition(order.Status, status); err != nil {
+		return err
+	}
+
+	if order.Status != status {
+		s.history[accrualOrderID] = append(s.history[accrualOrderID], status)
+	}
+	order.Status = status
+	if accrual != nil {
+		order.Accrual = *accrual
+	}
+	return nil
+}
+
+func (s *memStore) UpdateAccrual(ctx context.Context, accrualOrderID int, accrual float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[accrualOrderID]
+	if !ok {
+		return database.ErrOrderNotFound
+	}
+	order.Accrual = accrual
+	return nil
+}
+
+func (s *memStore) GetOrder(ctx context.Context, accrualOrderID int) (*models.Accrual, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[accrualOrderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (s *memStore) PublishPending(
+	ctx context.Context,
+	topic string,
+	limit int,
+	publish func([]models.OutboxMessage) error,
+) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := min(s.sent+limit, len(s.outbox))
+	if end == s.sent {
+		return 0, nil
+	}
+
+	if err := publish(s.outbox[s.sent:end]); err != nil {
+		return 0, err
+	}
+	claimed := end - s.sent
+	s.sent = end
+	return claimed, nil
+}
+
+func (s *memStore) OrderGoods(ctx context.Context, accrualOrderID int) ([]models.Good, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.goods[accrualOrderID], nil
+}
+
+func (s *memStore) Rewards(ctx context.Context) ([]models.Reward, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rewards, nil
+}
+
+func (s *memStore) order(accrualOrderID int) (models.Accrual, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[accrualOrderID]
+	if !ok {
+		return models.Accrual{}, nil
+	}
+	return *order, append([]string(nil), s.history[accrualOrderID]...)
+}
+
+// memWallet credits every order once like the sso withdrawals service
+type memWallet struct {
+	mu       sync.Mutex
+	credited map[int64]bool
+	balances map[int64]float64
+}
+
+func (w *memWallet) TopUp(ctx context.Context, order int64, userID int64, sum float64) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.credited[order] {
+		return false, nil
+	}
+	w.credited[order] = true
+	w.balances[userID] += sum
+	return true, nil
+}
+
+func (w *memWallet) balance(userID int64) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.balances[userID]
+}
+
+func TestOrderEndToEnd(t *testing.T) {
+	const (
+		orderID = 12345678903
+		userID  = 7
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the brokers of both services are built like devstack builds them, on the memory hub of the process
+	cfg := messaging.Config{
+		Broker: messaging.BrokerMemory,
+		Topics: messaging.Topics{
+			OrderCreated:   "e2e-order-created",
+			OrderCompleted: "e2e-order-completed",
+			OrderStatus:    "e2e-order-status",
+			TokenRevoked:   "e2e-token-revoked",
+		},
+		Encoding: messaging.EncodingJSON,
+	}
+	retry := messaging.RetryPolicy{Attempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	orders := newMemStore(models.StatusNew)
+	accruals := newMemStore(models.StatusRegistered)
+	wallet := &memWallet{credited: make(map[int64]bool), balances: make(map[int64]float64)}
+
+	// what a merchant registers through POST /api/goods and POST /api/orders
+	accruals.rewards = []models.Reward{{Match: "bork", Reward: 10, RewardType: models.RewardPercent}}
+	accruals.goods[orderID] = []models.Good{{Description: "Чайник Bork", Price: 7000}}
+
+	orderProcessor := orderservice.Processor{
+		DB:             orders,
+		Broker:         messaging.NewOrderBroker(cfg),
+		StatusBroker:   messaging.NewOrderStatusBroker(cfg),
+		WithdrawClient: wallet,
+		Topics:         cfg.Topics,
+		DeadLetters:    messaging.NewPublisher(cfg),
+		Retry:          retry,
+	}
+	relay := orderservice.Relay{
+		DB:          orders,
+		Topic:       messaging.TopicOrderCreated,
+		Destination: cfg.Topics.OrderCreated,
+		Publisher:   messaging.NewEventPublisher(cfg),
+		Interval:    10 * time.Millisecond,
+		BatchSize:   10,
+	}
+	loyaltyProcessor := loyaltyservice.Processor{
+		DB:           accruals,
+		Rewards:      accruals,
+		Broker:       messaging.NewLoyaltyBroker(cfg),
+		StatusBroker: messaging.NewLoyaltyStatusBroker(cfg),
+		Topics:       cfg.Topics,
+		DeadLetters:  messaging.NewPublisher(cfg),
+		Retry:        retry,
+		Workers:      2,
+		OrderTimeout: 5 * time.Second,
+	}
+
+	go orderProcessor.Process(ctx)
+	go relay.Run(ctx)
+	go loyaltyProcessor.Process(ctx)
+
+	// POST /api/user/orders
+	if _, err := orders.CreateAccrual(ctx, orderID, userID); err != nil {
+		t.Fatalf("create accrual: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		order, _ := orders.order(orderID)
+		if order.Status == models.StatusProcessed && wallet.balance(userID) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order wasn't processed in time: status %q, balance %v", order.Status, wallet.balance(userID))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	order, history := orders.order(orderID)
+	if order.Accrual != 700 {
+		t.Errorf("order accrual = %v, want 700", order.Accrual)
+	}
+	want := []string{models.StatusNew, models.StatusProcessing, models.StatusProcessed}
+	if len(history) != len(want) {
+		t.Fatalf("order history = %v, want %v", history, want)
+	}
+	for i := range want {
+		if history[i] != want[i] {
+			t.Fatalf("order history = %v, want %v", history, want)
+		}
+	}
+	if balance := wallet.balance(userID); balance != 700 {
+		t.Errorf("balance = %v, want 700", balance)
+	}
+
+	evaluated, _ := accruals.order(orderID)
+	if evaluated.Status != models.StatusProcessed || evaluated.Accrual != 700 {
+		t.Errorf("loyalty order = %+v, want PROCESSED with accrual 700", evaluated)
+	}
+}
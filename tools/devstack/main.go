@@ -0,0 +1,52 @@
+// Command devstack runs sso-service, order-service and loyalty-service in one process
+// for local development. The services exchange events through the memory broker, so
+// an order goes through accrual and top-up without kafka, only postgres is needed.
+//
+//	go run ./tools/devstack -js dev-secret -mk dev-merchant-key
+//
+// The service flags apply as usual, except the broker and the sso addresses:
+// sso listens on :5000-:5002 of this process.
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+
+	loyaltyservice "github.com/paranoiachains/loyalty-api/loyalty-service/service"
+	orderservice "github.com/paranoiachains/loyalty-api/order-service/service"
+	"github.com/paranoiachains/loyalty-api/pkg/flags"
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	ssoservice "github.com/paranoiachains/loyalty-api/sso-service/service"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+func main() {
+	// all services share the memory hub of the process
+	flags.Broker = messaging.BrokerMemory
+	flags.SSOAuthAddress = "localhost:5000"
+	flags.SSOWithdrawAddress = "localhost:5001"
+	flags.JWKSURL = "http://localhost:5002/.well-known/jwks.json"
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// a failing service stops the others
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return ssoservice.Run(ctx)
+	})
+	g.Go(func() error {
+		return orderservice.Run(ctx)
+	})
+	g.Go(func() error {
+		return loyaltyservice.Run(ctx)
+	})
+
+	if err := g.Wait(); err != nil {
+		logger.Log.Fatal("run devstack", zap.Error(err))
+	}
+	logger.Log.Info("devstack stopped")
+}
@@ -0,0 +1,53 @@
+// Command redrive moves dead-lettered messages back onto their source topic.
+//
+//	go run ./tools/redrive -topic order-completed
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/paranoiachains/loyalty-api/pkg/logger"
+	"github.com/paranoiachains/loyalty-api/pkg/messaging"
+	"go.uber.org/zap"
+)
+
+func main() {
+	brokers := flag.String("brokers", "kafka:9092", "comma separated kafka brokers")
+	groupID := flag.String("group", "redrive", "consumer group reading the dead-letter topic")
+	topic := flag.String("topic", "", "source topic whose dead letters are redriven")
+	limit := flag.Int("limit", 0, "max number of messages to redrive, 0 means all")
+	idle := flag.Duration("idle", 10*time.Second, "stop after no dead letters arrived for this long")
+	flag.Parse()
+
+	if *topic == "" {
+		log.Fatal("topic is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	cfg := messaging.Config{
+		Broker:      messaging.BrokerKafka,
+		Brokers:     strings.Split(*brokers, ","),
+		GroupID:     *groupID,
+		StartOffset: messaging.StartOffset("first"),
+		BatchSize:   1,
+	}
+
+	dead := messaging.NewKafkaService(messaging.CreateReader(cfg, messaging.DeadLetterTopic(*topic)), nil)
+	dead.Start(ctx)
+
+	moved, err := messaging.Redrive(ctx, dead.Receive(), messaging.NewKafkaPublisher(cfg), *limit, *idle)
+	if err != nil {
+		logger.Log.Error("redrive", zap.Int("moved", moved), zap.Error(err))
+		return
+	}
+
+	logger.Log.Info("redrive finished", zap.String("topic", *topic), zap.Int("moved", moved))
+}